@@ -20,6 +20,7 @@ const (
 	// encodingPackage = protogen.GoImportPath("github.com/go-kratos/kratos/v2/encoding")
 	// jsonPackage     = protogen.GoImportPath("github.com/go-kratos/kratos/v2/encoding/json")
 	// formPackage     = protogen.GoImportPath("github.com/go-kratos/kratos/v2/encoding/form")
+	errorsPackage   = protogen.GoImportPath("github.com/go-kratos/kratos/v2/errors")
 	logPackage      = protogen.GoImportPath("github.com/go-kratos/kratos/v2/log")
 	pahoMQttPackage = protogen.GoImportPath("github.com/eclipse/paho.mqtt.golang")
 	stringsPackage  = protogen.GoImportPath("strings")
@@ -52,6 +53,7 @@ func generateFileContent(gen *protogen.Plugin, file *protogen.File, g *protogen.
 	}
 	g.QualifiedGoIdent(protogen.GoIdent{GoName: "mqtt", GoImportPath: mqttPackage})
 	// g.QualifiedGoIdent(protogen.GoIdent{GoName: "encoding", GoImportPath: encodingPackage})
+	g.QualifiedGoIdent(protogen.GoIdent{GoName: "errors", GoImportPath: errorsPackage})
 	g.QualifiedGoIdent(protogen.GoIdent{GoName: "log", GoImportPath: logPackage})
 	// g.QualifiedGoIdent(protogen.GoIdent{GoName: "json", GoImportPath: jsonPackage})
 	// g.QualifiedGoIdent(protogen.GoIdent{GoName: "form", GoImportPath: formPackage})
@@ -61,6 +63,7 @@ func generateFileContent(gen *protogen.Plugin, file *protogen.File, g *protogen.
 	g.P("// This is a compile-time assertion to ensure that this generated file")
 	g.P("// is compatible with the kratos package it is being compiled against.")
 	g.P("var _ = new(", contextPackage.Ident("Context"), ")")
+	g.P("const _ = ", mqttPackage.Ident("SupportPackageIsVersion2"))
 	// g.P("var jsonCodec =", encodingPackage.Ident("GetCodec(json.Name)"))
 	// g.P("var formCodec =", encodingPackage.Ident("GetCodec(form.Name)"))
 	g.P("var glog =", logPackage.Ident("NewHelper(log.DefaultLogger)"))
@@ -215,13 +218,14 @@ func buildMethodDesc(g *protogen.GeneratedFile, m *protogen.Method, method, path
 		}
 	}
 	return &methodDesc{
-		Name:    m.GoName,
-		Num:     methodSets[m.GoName],
-		Request: g.QualifiedGoIdent(m.Input.GoIdent),
-		Reply:   g.QualifiedGoIdent(m.Output.GoIdent),
-		Path:    path,
-		Method:  method,
-		HasVars: len(vars) > 0,
+		Name:         m.GoName,
+		OriginalName: string(m.Desc.Name()),
+		Num:          methodSets[m.GoName],
+		Request:      g.QualifiedGoIdent(m.Input.GoIdent),
+		Reply:        g.QualifiedGoIdent(m.Output.GoIdent),
+		Path:         path,
+		Method:       method,
+		HasVars:      len(vars) > 0,
 	}
 }
 
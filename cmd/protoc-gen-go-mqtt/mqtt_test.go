@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"flag"
+	"os"
 	"reflect"
 	"testing"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/pluginpb"
 )
 
 func TestNoParameters(t *testing.T) {
@@ -85,3 +93,55 @@ func TestIterationMiddle(t *testing.T) {
 		t.Fatal(`replacePath("message.name", "messages/*", path) should be "/test/{message.name:messages/.*}/books"`)
 	}
 }
+
+// greeterGolden is the generated code of the handlers tested in the mqtt
+// transport, regenerated with -update.
+const greeterGolden = "../../transport/mqtt/internal/testgreeter/greeter_mqtt.pb.go"
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestGenerateGreeter(t *testing.T) {
+	req := &pluginpb.CodeGeneratorRequest{
+		FileToGenerate: []string{"greeter.proto"},
+		ProtoFile: []*descriptorpb.FileDescriptorProto{{
+			Name:    proto.String("greeter.proto"),
+			Package: proto.String("helloworld"),
+			Syntax:  proto.String("proto3"),
+			Options: &descriptorpb.FileOptions{
+				GoPackage: proto.String("github.com/bytectl/gopkg/transport/mqtt/internal/testgreeter"),
+			},
+			MessageType: []*descriptorpb.DescriptorProto{
+				{Name: proto.String("HelloRequest")},
+				{Name: proto.String("HelloReply")},
+			},
+			Service: []*descriptorpb.ServiceDescriptorProto{{
+				Name: proto.String("Greeter"),
+				Method: []*descriptorpb.MethodDescriptorProto{{
+					Name:       proto.String("SayHello"),
+					InputType:  proto.String(".helloworld.HelloRequest"),
+					OutputType: proto.String(".helloworld.HelloReply"),
+				}},
+			}},
+		}},
+	}
+	gen, err := protogen.Options{}.New(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := generateFile(gen, gen.Files[0], false).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err = os.WriteFile(greeterGolden, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := os.ReadFile(greeterGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, golden) {
+		t.Errorf("%s is out of date, run the test with -update", greeterGolden)
+	}
+}
@@ -24,10 +24,10 @@ func Subscribe{{.ServiceType}}(c paho_mqtt_golang.Client, m *mqtt.MQTTSubscribe)
 	{{- end}}
 }
 
-func Register{{.ServiceType}}MQTTServer(s *mqtt.Server, srv {{.ServiceType}}MQTTServer) {
+func Register{{.ServiceType}}MQTTServer(s *mqtt.Server, srv {{.ServiceType}}MQTTServer, opts ...mqtt.RouteOption) {
 	r := s.Route()
 	{{- range .MethodSets}}
-	r.Handle("{{.Path}}", _{{$svrType}}_{{.Name}}{{.Num}}_MQTT_Handler(srv))
+	r.Handle("{{.Path}}", _{{$svrType}}_{{.Name}}{{.Num}}_MQTT_Handler(srv), opts...)
 	{{- end}}
 }
 
@@ -38,7 +38,10 @@ func _{{$svrType}}_{{.Name}}{{.Num}}_MQTT_Handler(srv {{$svrType}}MQTTServer) fu
 		in :=&{{.Request}}{}
 		err := ctx.Bind(in)
 		if err != nil {
-			glog.Error("message error:", err)
+			ctx.DeadLetter(mqtt.ReasonDecode, err)
+			if err = ctx.ReplyErr(errors.BadRequest("CODEC", err.Error())); err != nil {
+				glog.Error("{{.Name}} reply error:", err)
+			}
 			return
 		}
 		err = ctx.BindVars(in)
@@ -48,27 +51,36 @@ func _{{$svrType}}_{{.Name}}{{.Num}}_MQTT_Handler(srv {{$svrType}}MQTTServer) fu
 		glog.Debugf("receive mqtt topic:%v, in: %+v", ctx.Message().Topic(), in)
 		err = in.Validate()
 		if err != nil {
-			glog.Error("validate error:", err)
+			ctx.DeadLetter(mqtt.ReasonValidate, err)
+			if err = ctx.ReplyErr(errors.BadRequest("VALIDATOR", err.Error())); err != nil {
+				glog.Error("{{.Name}} reply error:", err)
+			}
 			return
 		}
 		glog.Debugf("receive mqtt request:%+v",in)
-		reply, err := srv.{{.Name}}(ctx, in)
-		if reply == nil {
-			glog.Debugf(" mqtt topic:%v, no need reply", ctx.Message().Topic())
-			if err != nil {
-				glog.Error("{{.Name}} error:", err)
+		mqtt.SetOperation(ctx, "/{{$svrName}}/{{.OriginalName}}")
+		h := ctx.Middleware(func(ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.{{.Name}}(ctx.(mqtt.Context), req.(*{{.Request}}))
+		})
+		out, err := h(ctx, in)
+		if err != nil {
+			glog.Error("{{.Name}} error:", err)
+			if err = ctx.ReplyErr(err); err != nil {
+				glog.Error("{{.Name}} reply error:", err)
 			}
 			return
 		}
-		if err != nil {
-			glog.Error("{{.Name}} error:", err)
-			ctx.ReplyErr(err)
+		reply, _ := out.(*{{.Reply}})
+		if reply == nil {
+			glog.Debugf(" mqtt topic:%v, no need reply", ctx.Message().Topic())
 			return
 		}
 		err = ctx.Reply(reply)
 		if err != nil {
-			glog.Error("{{.Name}} error:", err)
-			ctx.ReplyErr(err)
+			glog.Error("{{.Name}} reply error:", err)
+			if err = ctx.ReplyErr(err); err != nil {
+				glog.Error("{{.Name}} reply error:", err)
+			}
 			return
 		}
 	}
@@ -88,10 +100,11 @@ type serviceDesc struct {
 
 type methodDesc struct {
 	// method
-	Name    string
-	Num     int
-	Request string
-	Reply   string
+	Name         string
+	OriginalName string // The parsed original name
+	Num          int
+	Request      string
+	Reply        string
 	// http_rule
 	Path         string
 	Method       string
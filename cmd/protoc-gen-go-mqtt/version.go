@@ -1,4 +1,4 @@
 package main
 
 // release is the current protoc-gen-go-mqtt version.
-const release = "v2.0.1"
+const release = "v2.1.0"
@@ -0,0 +1,60 @@
+package amqp
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bytectl/gopkg/transport/health"
+)
+
+var _ health.Checker = (*Server)(nil)
+
+// connState is the connection state of the server.
+type connState struct {
+	mu          sync.Mutex
+	lastErr     error
+	lastConnect time.Time
+}
+
+func (s *connState) connected() {
+	s.mu.Lock()
+	s.lastConnect = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *connState) failed(err error) {
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+}
+
+// Health returns the health of the server: the connection state, the last
+// connect time and error. It is ready when connected.
+func (s *Server) Health() health.Status {
+	st := health.Status{
+		Name:      "amqp",
+		Endpoint:  redactURL(s.url),
+		Connected: s.Ready(),
+	}
+	st.Ready = st.Connected
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	if s.state.lastErr != nil {
+		st.LastError = s.state.lastErr.Error()
+	}
+	if !s.state.lastConnect.IsZero() {
+		t := s.state.lastConnect
+		st.LastConnect = &t
+	}
+	return st
+}
+
+// redactURL drops the password of the url.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,44 @@
+package amqp
+
+import (
+	"github.com/bytectl/gopkg/transport/internal/metric"
+	"github.com/go-kratos/kratos/v2/metrics"
+)
+
+// The statuses of the message counter.
+const (
+	StatusReceived = metric.StatusReceived
+	StatusHandled  = "handled"
+	StatusFailed   = metric.StatusFailed
+)
+
+// MessageCounter with the counter of the handled deliveries, labeled with
+// the route and the status: received, then handled or failed.
+func MessageCounter(c metrics.Counter) ServerOption {
+	return func(s *Server) {
+		s.metrics.Messages = c
+	}
+}
+
+// HandleSeconds with the observer of the handler latency in seconds, labeled
+// with the route.
+func HandleSeconds(m metrics.Observer) ServerOption {
+	return func(s *Server) {
+		s.metrics.Seconds = m
+	}
+}
+
+// ConnectionGauge with the gauge of the connection state, 1 when connected,
+// else 0.
+func ConnectionGauge(g metrics.Gauge) ServerOption {
+	return func(s *Server) {
+		s.metrics.Connected = g
+	}
+}
+
+// ReconnectCounter with the counter of the reconnects.
+func ReconnectCounter(c metrics.Counter) ServerOption {
+	return func(s *Server) {
+		s.metrics.Reconnects = c
+	}
+}
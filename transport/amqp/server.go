@@ -3,12 +3,17 @@ package amqp
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/bytectl/gopkg/transport/internal/metric"
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/go-kratos/kratos/v2/transport"
 	ramqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -80,6 +85,14 @@ func Locale(locale string) ServerOption {
 		s.config.Locale = locale
 	}
 }
+
+// ConnectRetry makes Start return at once and connect in the background.
+func ConnectRetry(connectRetry bool) ServerOption {
+	return func(s *Server) {
+		s.connectRetry = connectRetry
+	}
+}
+
 func ReconnectInterval(interval time.Duration) ServerOption {
 	return func(s *Server) {
 		s.reconnectInterval = interval
@@ -117,11 +130,17 @@ type Server struct {
 	log               *log.Helper
 	url               string
 	config            *ramqp.Config
+	mu                sync.RWMutex
 	amqpConn          *ramqp.Connection
+	connectRetry      bool
 	notifyCloseChan   chan *ramqp.Error
 	reconnectInterval time.Duration
 	onConnect         OnConnect
 	connectionLost    ConnectionLost
+	tracer            trace.Tracer
+	propagator        propagation.TextMapPropagator
+	metrics           metric.Metrics
+	state             connState
 }
 
 // NewServer creates an MQTT server by options.
@@ -145,6 +164,7 @@ func NewServer(opts ...ServerOption) *Server {
 		reconnectInterval: time.Second * 5,
 		onConnect:         defaultOnConnect,
 		connectionLost:    defaultConnectionLost,
+		propagator:        propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
 	}
 	for _, o := range opts {
 		o(srv)
@@ -152,19 +172,70 @@ func NewServer(opts ...ServerOption) *Server {
 	return srv
 }
 
+// Start connects to the server, it waits for the connection until the ctx
+// is done. With ConnectRetry it returns at once and keeps connecting in the
+// background, see Ready.
 func (s *Server) Start(ctx context.Context) error {
 	s.log.Info("[amqp] server starting")
-	conn, err := ramqp.DialConfig(s.url, *s.config)
+	if s.connectRetry {
+		go func() {
+			s.reconnect(ctx)
+			s.connNotifyClose(ctx)
+		}()
+		return nil
+	}
+	conn, err := s.dial(ctx)
 	if err != nil {
-		panic("amqp connect error," + err.Error())
+		s.state.failed(err)
+		return fmt.Errorf("amqp connect error: %w", err)
+	}
+	s.setConn(conn)
+	go s.connNotifyClose(ctx)
+	return nil
+}
+
+// Ready reports whether the server is connected.
+func (s *Server) Ready() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.amqpConn != nil && !s.amqpConn.IsClosed()
+}
+
+// dial dials the server, giving up when the ctx is done.
+func (s *Server) dial(ctx context.Context) (*ramqp.Connection, error) {
+	type result struct {
+		conn *ramqp.Connection
+		err  error
 	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := ramqp.DialConfig(s.url, *s.config)
+		ch <- result{conn, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// setConn installs the connection and calls onConnect.
+func (s *Server) setConn(conn *ramqp.Connection) {
 	// set notifyClose channal
 	conn.NotifyClose(s.notifyCloseChan)
+	s.mu.Lock()
 	s.amqpConn = conn
+	s.mu.Unlock()
+	s.metrics.Connect()
+	s.state.connected()
 	// call onConnect
-	s.onConnect(s.amqpConn)
-	go s.connNotifyClose(ctx)
-	return nil
+	s.onConnect(conn)
 }
 
 func (s *Server) connNotifyClose(ctx context.Context) {
@@ -172,8 +243,15 @@ func (s *Server) connNotifyClose(ctx context.Context) {
 		select {
 		case err := <-s.notifyCloseChan:
 			s.log.Errorf("[amqp] conn closed,error(%v)", err)
+			s.metrics.Disconnect()
+			if err != nil {
+				s.state.failed(err)
+			}
 			// call connectionLost
-			s.connectionLost(s.amqpConn, err)
+			s.mu.RLock()
+			conn := s.amqpConn
+			s.mu.RUnlock()
+			s.connectionLost(conn, err)
 			// reconnect
 			s.reconnect(ctx)
 		case <-ctx.Done():
@@ -193,17 +271,17 @@ func (s *Server) reconnect(ctx context.Context) {
 			return
 		default:
 			s.log.Info("[amqp] server reconnecting")
-			conn, err := ramqp.DialConfig(s.url, *s.config)
+			conn, err := s.dial(ctx)
 			if err != nil {
 				s.log.Errorf("[amqp] server reconnect error(%v)", err)
-				time.Sleep(s.reconnectInterval)
+				s.state.failed(err)
+				select {
+				case <-time.After(s.reconnectInterval):
+				case <-ctx.Done():
+				}
 				continue
 			}
-			// set notifyClose channal
-			conn.NotifyClose(s.notifyCloseChan)
-			s.amqpConn = conn
-			// call onConnect
-			s.onConnect(s.amqpConn)
+			s.setConn(conn)
 			return
 		}
 	}
@@ -211,8 +289,12 @@ func (s *Server) reconnect(ctx context.Context) {
 
 func (s *Server) Stop(ctx context.Context) error {
 	s.log.Info("[amqp] server stopping")
-	if s.amqpConn != nil {
-		return s.amqpConn.Close()
+	s.mu.RLock()
+	conn := s.amqpConn
+	s.mu.RUnlock()
+	s.metrics.Disconnect()
+	if conn != nil {
+		return conn.Close()
 	}
 	return nil
 }
@@ -0,0 +1,159 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+
+	ramqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/bytectl/gopkg/transport/amqp"
+
+// TracerProvider with the tracer provider of the delivery spans, the
+// deliveries are not traced by default.
+func TracerProvider(tp trace.TracerProvider) ServerOption {
+	return func(s *Server) {
+		s.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// Propagator with the propagator of the trace context carried in the
+// message headers, defaults to the W3C trace context and baggage.
+func Propagator(p propagation.TextMapPropagator) ServerOption {
+	return func(s *Server) {
+		s.propagator = p
+	}
+}
+
+// HandlerFunc handles a delivery, it acks or rejects it. A delivery whose
+// handler panicked before acking it is nacked without requeue.
+type HandlerFunc func(ctx context.Context, d ramqp.Delivery) error
+
+// Handle returns the handler of the deliveries of the route, eg the queue
+// name, tracing and measuring h:
+//
+//	handle := srv.Handle("orders", h)
+//	for d := range deliveries {
+//		handle(d)
+//	}
+func (s *Server) Handle(route string, h HandlerFunc) func(ramqp.Delivery) {
+	return func(d ramqp.Delivery) {
+		start := time.Now()
+		ctx := context.Background()
+		if s.tracer != nil {
+			var span trace.Span
+			ctx, span = s.startSpan(ctx, route, &d)
+			defer span.End()
+		}
+		s.metrics.Received(route)
+		status := StatusHandled
+		if err := s.handle(ctx, h, d); err != nil {
+			status = StatusFailed
+			span := trace.SpanFromContext(ctx)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			s.log.Errorf("[amqp] handle route: %s, routing key: %s error(%v)", route, d.RoutingKey, err)
+		}
+		s.metrics.Handled(route, status, time.Since(start))
+	}
+}
+
+// handle runs h, a panic is logged with its stack and returned as an error,
+// the delivery is nacked without requeue unless h acked, nacked or rejected
+// it before panicking.
+func (s *Server) handle(ctx context.Context, h HandlerFunc, d ramqp.Delivery) (err error) {
+	ack := &acknowledger{Acknowledger: d.Acknowledger}
+	if d.Acknowledger != nil {
+		d.Acknowledger = ack
+	}
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			s.log.Errorf("[amqp] panic routing key: %s, %v: %s", d.RoutingKey, rcv, stack())
+			err = fmt.Errorf("panic: %v", rcv)
+			if ack.Acknowledger != nil && !ack.done {
+				if nerr := ack.Nack(d.DeliveryTag, false, false); nerr != nil {
+					s.log.Errorf("[amqp] nack routing key: %s error(%v)", d.RoutingKey, nerr)
+				}
+			}
+		}
+	}()
+	return h(ctx, d)
+}
+
+// acknowledger records whether the handler acked, nacked or rejected the
+// delivery, the handler runs on a single goroutine.
+type acknowledger struct {
+	ramqp.Acknowledger
+	done bool
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	a.done = true
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a *acknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.done = true
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	a.done = true
+	return a.Acknowledger.Reject(tag, requeue)
+}
+
+func stack() []byte {
+	buf := make([]byte, 64<<10)
+	return buf[:runtime.Stack(buf, false)]
+}
+
+// InjectHeaders injects the trace context of ctx into the headers of a
+// message to publish.
+func (s *Server) InjectHeaders(ctx context.Context, headers ramqp.Table) {
+	s.propagator.Inject(ctx, tableCarrier(headers))
+}
+
+// startSpan starts the consumer span of the delivery, continuing the trace
+// context of its headers.
+func (s *Server) startSpan(ctx context.Context, route string, d *ramqp.Delivery) (context.Context, trace.Span) {
+	if d.Headers != nil {
+		ctx = s.propagator.Extract(ctx, tableCarrier(d.Headers))
+	}
+	return s.tracer.Start(ctx, route, trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		semconv.MessagingSystemKey.String("rabbitmq"),
+		semconv.MessagingDestinationKey.String(d.Exchange),
+		semconv.MessagingOperationProcess,
+		semconv.MessagingMessagePayloadSizeBytesKey.Int(len(d.Body)),
+		semconv.MessagingRabbitmqRoutingKeyKey.String(d.RoutingKey),
+		attribute.String("messaging.amqp.route", route),
+	))
+}
+
+// tableCarrier is the propagation.TextMapCarrier of the message headers.
+type tableCarrier ramqp.Table
+
+func (t tableCarrier) Get(key string) string {
+	if v, ok := t[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+func (t tableCarrier) Set(key string, value string) {
+	t[key] = value
+}
+
+func (t tableCarrier) Keys() []string {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	return keys
+}
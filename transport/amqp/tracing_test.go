@@ -0,0 +1,77 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bytectl/gopkg/transport/internal/testutil"
+	ramqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestServerHandle(t *testing.T) {
+	tp := &testutil.Tracer{}
+	messages := testutil.NewMetric()
+	srv := NewServer(TracerProvider(tp), MessageCounter(messages.Counter()))
+	handle := srv.Handle("orders", func(ctx context.Context, d ramqp.Delivery) error {
+		if string(d.Body) == "bad" {
+			return errors.New("bad order")
+		}
+		return nil
+	})
+	headers := ramqp.Table{}
+	srv.InjectHeaders(trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	})), headers)
+	handle(ramqp.Delivery{Headers: headers, Body: []byte("ok")})
+	handle(ramqp.Delivery{Body: []byte("bad")})
+
+	if len(tp.Spans) != 2 || tp.Spans[0].Name != "orders" {
+		t.Fatalf("expected 2 spans, got %v", tp.Spans)
+	}
+	if tp.Spans[0].Parent.SpanID() != (trace.SpanID{2}) || !tp.Spans[0].Parent.IsRemote() {
+		t.Errorf("expected the trace context continued, got %v", tp.Spans[0].Parent)
+	}
+	if tp.Spans[1].Code != codes.Error {
+		t.Errorf("expected the failure recorded, got %v", tp.Spans[1].Code)
+	}
+	want := map[string]float64{"orders,received": 2, "orders,handled": 1, "orders,failed": 1}
+	for k, v := range want {
+		if messages.Get(k) != v {
+			t.Errorf("%s: expected %v, got %v", k, v, messages.Get(k))
+		}
+	}
+}
+
+// testAcknowledger records the acks and nacks.
+type testAcknowledger struct {
+	acks, nacks int
+}
+
+func (a *testAcknowledger) Ack(uint64, bool) error        { a.acks++; return nil }
+func (a *testAcknowledger) Nack(uint64, bool, bool) error { a.nacks++; return nil }
+func (a *testAcknowledger) Reject(uint64, bool) error     { a.nacks++; return nil }
+
+func TestServerHandlePanic(t *testing.T) {
+	srv := NewServer()
+	handle := srv.Handle("orders", func(ctx context.Context, d ramqp.Delivery) error {
+		if string(d.Body) == "acked" {
+			d.Ack(false)
+		}
+		panic("bad order")
+	})
+	a := &testAcknowledger{}
+	handle(ramqp.Delivery{Acknowledger: a, Body: []byte("new")})
+	if a.acks != 0 || a.nacks != 1 {
+		t.Errorf("expected the delivery nacked, got %+v", a)
+	}
+	a = &testAcknowledger{}
+	handle(ramqp.Delivery{Acknowledger: a, Body: []byte("acked")})
+	if a.acks != 1 || a.nacks != 0 {
+		t.Errorf("expected the acked delivery not nacked, got %+v", a)
+	}
+}
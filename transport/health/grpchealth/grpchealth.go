@@ -0,0 +1,77 @@
+// Package grpchealth serves the health registry as the gRPC health service.
+package grpchealth
+
+import (
+	"context"
+	"time"
+
+	"github.com/bytectl/gopkg/transport/health"
+	"google.golang.org/grpc/codes"
+	pb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+var _ pb.HealthServer = (*Server)(nil)
+
+// Server is the gRPC health service of a registry, the empty service
+// reports the whole registry, a transport name that transport:
+//
+//	pb.RegisterHealthServer(grpcSrv, grpchealth.NewServer(registry))
+type Server struct {
+	pb.UnimplementedHealthServer
+	registry *health.Registry
+	interval time.Duration
+}
+
+// NewServer returns the gRPC health service of the registry.
+func NewServer(r *health.Registry) *Server {
+	return &Server{registry: r, interval: time.Second}
+}
+
+func (s *Server) status(service string) (pb.HealthCheckResponse_ServingStatus, bool) {
+	ready := false
+	if service == "" {
+		ready = s.registry.Check().Ready
+	} else {
+		st, ok := s.registry.CheckName(service)
+		if !ok {
+			return pb.HealthCheckResponse_SERVICE_UNKNOWN, false
+		}
+		ready = st.Ready
+	}
+	if ready {
+		return pb.HealthCheckResponse_SERVING, true
+	}
+	return pb.HealthCheckResponse_NOT_SERVING, true
+}
+
+// Check returns the serving status of the service.
+func (s *Server) Check(ctx context.Context, in *pb.HealthCheckRequest) (*pb.HealthCheckResponse, error) {
+	st, ok := s.status(in.Service)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "unknown service")
+	}
+	return &pb.HealthCheckResponse{Status: st}, nil
+}
+
+// Watch streams the serving status of the service on every change, it is
+// polled every second.
+func (s *Server) Watch(in *pb.HealthCheckRequest, stream pb.Health_WatchServer) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	last := pb.HealthCheckResponse_ServingStatus(-1)
+	for {
+		st, _ := s.status(in.Service)
+		if st != last {
+			if err := stream.Send(&pb.HealthCheckResponse{Status: st}); err != nil {
+				return status.Error(codes.Canceled, "stream has ended")
+			}
+			last = st
+		}
+		select {
+		case <-ticker.C:
+		case <-stream.Context().Done():
+			return status.Error(codes.Canceled, "stream has ended")
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package grpchealth
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bytectl/gopkg/transport/health"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	pb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type testChecker struct {
+	mu    sync.Mutex
+	name  string
+	ready bool
+}
+
+func (c *testChecker) Health() health.Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return health.Status{Name: c.name, Connected: c.ready, Ready: c.ready}
+}
+
+func (c *testChecker) set(ready bool) {
+	c.mu.Lock()
+	c.ready = ready
+	c.mu.Unlock()
+}
+
+// newTestClient serves the health service of the registry on a bufconn
+// listener and returns a client of it.
+func newTestClient(t *testing.T, r *health.Registry) pb.HealthClient {
+	lis := bufconn.Listen(1 << 20)
+	srv := NewServer(r)
+	srv.interval = 10 * time.Millisecond
+	grpcSrv := grpc.NewServer()
+	pb.RegisterHealthServer(grpcSrv, srv)
+	go func() { _ = grpcSrv.Serve(lis) }()
+	t.Cleanup(grpcSrv.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return pb.NewHealthClient(conn)
+}
+
+func TestCheck(t *testing.T) {
+	mqtt := &testChecker{name: "mqtt", ready: true}
+	amqp := &testChecker{name: "amqp"}
+	client := newTestClient(t, health.New(mqtt, amqp))
+	ctx := context.Background()
+
+	tests := []struct {
+		service string
+		want    pb.HealthCheckResponse_ServingStatus
+	}{
+		{"", pb.HealthCheckResponse_NOT_SERVING},
+		{"mqtt", pb.HealthCheckResponse_SERVING},
+		{"amqp", pb.HealthCheckResponse_NOT_SERVING},
+	}
+	for _, test := range tests {
+		reply, err := client.Check(ctx, &pb.HealthCheckRequest{Service: test.service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Status != test.want {
+			t.Errorf("service %q: expected %v, got %v", test.service, test.want, reply.Status)
+		}
+	}
+
+	amqp.set(true)
+	reply, err := client.Check(ctx, &pb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Status != pb.HealthCheckResponse_SERVING {
+		t.Errorf("expected SERVING once every transport is ready, got %v", reply.Status)
+	}
+
+	_, err = client.Check(ctx, &pb.HealthCheckRequest{Service: "kafka"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for an unknown service, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	mqtt := &testChecker{name: "mqtt"}
+	client := newTestClient(t, health.New(mqtt))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &pb.HealthCheckRequest{Service: "mqtt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := func(want pb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		reply, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Status != want {
+			t.Fatalf("expected %v, got %v", want, reply.Status)
+		}
+	}
+	recv(pb.HealthCheckResponse_NOT_SERVING)
+	mqtt.set(true)
+	recv(pb.HealthCheckResponse_SERVING)
+	mqtt.set(false)
+	recv(pb.HealthCheckResponse_NOT_SERVING)
+
+	cancel()
+	if _, err = stream.Recv(); status.Code(err) != codes.Canceled {
+		t.Errorf("expected the stream canceled, got %v", err)
+	}
+}
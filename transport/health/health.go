@@ -0,0 +1,131 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/transport"
+)
+
+// Status is the health of a transport.
+type Status struct {
+	Name      string `json:"name"`
+	Endpoint  string `json:"endpoint,omitempty"`
+	Connected bool   `json:"connected"`
+	// Ready is set when connected with every subscription active.
+	Ready         bool           `json:"ready"`
+	LastError     string         `json:"last_error,omitempty"`
+	LastConnect   *time.Time     `json:"last_connect,omitempty"`
+	Subscriptions []Subscription `json:"subscriptions,omitempty"`
+}
+
+// Subscription is the status of a subscription of a transport.
+type Subscription struct {
+	Topic      string `json:"topic"`
+	Qos        byte   `json:"qos"`
+	Subscribed bool   `json:"subscribed"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Checker reports the health of a transport.
+type Checker interface {
+	Health() Status
+}
+
+// Report is the health of the registered transports.
+type Report struct {
+	Ready      bool     `json:"ready"`
+	Transports []Status `json:"transports"`
+}
+
+// Registry aggregates the health of the registered transports.
+type Registry struct {
+	mu       sync.RWMutex
+	names    []string
+	checkers map[string]Checker
+}
+
+// New returns a registry of the checkers, named after their status.
+func New(checkers ...Checker) *Registry {
+	r := &Registry{checkers: make(map[string]Checker)}
+	for _, c := range checkers {
+		r.Register("", c)
+	}
+	return r
+}
+
+// FromServers returns a registry of the kratos servers reporting their
+// health, eg the servers of the kratos app.
+func FromServers(servers ...transport.Server) *Registry {
+	r := New()
+	for _, srv := range servers {
+		if c, ok := srv.(Checker); ok {
+			r.Register("", c)
+		}
+	}
+	return r
+}
+
+// Register registers the checker under the name, an empty name defaults to
+// the name of its status, suffixed when already registered.
+func (r *Registry) Register(name string, c Checker) {
+	if name == "" {
+		name = c.Health().Name
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.checkers[name]; ok {
+		for i := 2; ; i++ {
+			if _, ok := r.checkers[name+"-"+strconv.Itoa(i)]; !ok {
+				name = name + "-" + strconv.Itoa(i)
+				break
+			}
+		}
+	}
+	r.names = append(r.names, name)
+	r.checkers[name] = c
+}
+
+// Check returns the health of the registered transports, ready when every
+// one is ready.
+func (r *Registry) Check() Report {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	report := Report{Ready: true, Transports: make([]Status, 0, len(r.names))}
+	for _, name := range r.names {
+		st := r.checkers[name].Health()
+		st.Name = name
+		report.Ready = report.Ready && st.Ready
+		report.Transports = append(report.Transports, st)
+	}
+	return report
+}
+
+// CheckName returns the health of the named transport.
+func (r *Registry) CheckName(name string) (Status, bool) {
+	r.mu.RLock()
+	c, ok := r.checkers[name]
+	r.mu.RUnlock()
+	if !ok {
+		return Status{}, false
+	}
+	st := c.Health()
+	st.Name = name
+	return st, true
+}
+
+// ServeHTTP writes the JSON health report, with status 200 when ready, else
+// 503, eg as the readiness probe of a kratos HTTP server:
+//
+//	httpSrv.Handle("/healthz", health.FromServers(mqttSrv, amqpSrv))
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report := r.Check()
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
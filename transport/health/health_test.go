@@ -0,0 +1,44 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testChecker Status
+
+func (c *testChecker) Health() Status { return Status(*c) }
+
+func TestRegistry(t *testing.T) {
+	mqtt := &testChecker{Name: "mqtt", Connected: true, Ready: true}
+	amqp := &testChecker{Name: "amqp", Connected: true, Ready: true}
+	r := New(mqtt, amqp, &testChecker{Name: "mqtt", Ready: true})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || !report.Ready || len(report.Transports) != 3 {
+		t.Fatalf("expected ready, got %d %+v", rec.Code, report)
+	}
+	if report.Transports[2].Name != "mqtt-2" {
+		t.Errorf("expected the duplicate suffixed, got %s", report.Transports[2].Name)
+	}
+
+	amqp.Ready, amqp.LastError = false, "connection refused"
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", rec.Code)
+	}
+	if st, ok := r.CheckName("amqp"); !ok || st.Ready || st.LastError != "connection refused" {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if _, ok := r.CheckName("kafka"); ok {
+		t.Error("expected unknown transport")
+	}
+}
@@ -0,0 +1,65 @@
+// Package metric holds the metrics shared by the message servers.
+package metric
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/metrics"
+)
+
+// The statuses of the message counter shared by the servers.
+const (
+	StatusReceived = "received"
+	StatusFailed   = "failed"
+)
+
+// Metrics are the optional server metrics, every one may be nil.
+type Metrics struct {
+	Messages   metrics.Counter
+	Seconds    metrics.Observer
+	Connected  metrics.Gauge
+	Reconnects metrics.Counter
+
+	mu       sync.Mutex
+	connects int
+}
+
+// Received counts a message of the route.
+func (m *Metrics) Received(route string) {
+	if m.Messages != nil {
+		m.Messages.With(route, StatusReceived).Inc()
+	}
+}
+
+// Handled counts the outcome of a message of the route, an empty status is
+// not counted, and observes its latency.
+func (m *Metrics) Handled(route string, status string, d time.Duration) {
+	if m.Messages != nil && status != "" {
+		m.Messages.With(route, status).Inc()
+	}
+	if m.Seconds != nil {
+		m.Seconds.With(route).Observe(d.Seconds())
+	}
+}
+
+// Connect records a connect, every one after the first is a reconnect.
+func (m *Metrics) Connect() {
+	m.mu.Lock()
+	m.connects++
+	reconnect := m.connects > 1
+	m.mu.Unlock()
+	if m.Connected != nil {
+		m.Connected.Set(1)
+	}
+	if reconnect && m.Reconnects != nil {
+		m.Reconnects.Inc()
+	}
+}
+
+// Disconnect records the connection lost.
+func (m *Metrics) Disconnect() {
+	if m.Connected != nil {
+		m.Connected.Set(0)
+	}
+}
@@ -0,0 +1,142 @@
+// Package testutil holds the tracing and metrics fakes of the server tests.
+package testutil
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kratos/kratos/v2/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer is a trace.TracerProvider recording the spans.
+type Tracer struct {
+	mu    sync.Mutex
+	Spans []*Span
+}
+
+// Span is a recorded span.
+type Span struct {
+	trace.Span
+	Name   string
+	Kind   trace.SpanKind
+	Parent trace.SpanContext
+	SC     trace.SpanContext
+	Attrs  map[attribute.Key]attribute.Value
+	Code   codes.Code
+	Desc   string
+	Ended  bool
+}
+
+func (tt *Tracer) Tracer(string, ...trace.TracerOption) trace.Tracer { return tt }
+
+func (tt *Tracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	cfg := trace.NewSpanStartConfig(opts...)
+	parent := trace.SpanContextFromContext(ctx)
+	traceID := parent.TraceID()
+	if !traceID.IsValid() {
+		traceID = trace.TraceID{1}
+	}
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	s := &Span{
+		Span:   trace.SpanFromContext(context.Background()),
+		Name:   name,
+		Kind:   cfg.SpanKind(),
+		Parent: parent,
+		SC: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceID,
+			SpanID:     trace.SpanID{byte(len(tt.Spans) + 1)},
+			TraceFlags: trace.FlagsSampled,
+		}),
+		Attrs: make(map[attribute.Key]attribute.Value),
+	}
+	for _, kv := range cfg.Attributes() {
+		s.Attrs[kv.Key] = kv.Value
+	}
+	tt.Spans = append(tt.Spans, s)
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+func (s *Span) SpanContext() trace.SpanContext         { return s.SC }
+func (s *Span) IsRecording() bool                      { return true }
+func (s *Span) SetStatus(code codes.Code, desc string) { s.Code, s.Desc = code, desc }
+func (s *Span) End(...trace.SpanEndOption)             { s.Ended = true }
+
+// Metric is a metrics.Counter, Gauge and Observer counting the calls per
+// labels.
+type Metric struct {
+	mu     *sync.Mutex
+	values map[string]float64
+	lvs    []string
+}
+
+// NewMetric returns an empty metric.
+func NewMetric() *Metric {
+	return &Metric{mu: new(sync.Mutex), values: make(map[string]float64)}
+}
+
+func (m *Metric) with(lvs ...string) *Metric {
+	return &Metric{mu: m.mu, values: m.values, lvs: lvs}
+}
+
+func (m *Metric) add(v float64, set bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := strings.Join(m.lvs, ",")
+	if set {
+		m.values[key] = v
+	} else {
+		m.values[key] += v
+	}
+}
+
+// Get returns the value of the labels.
+func (m *Metric) Get(lvs ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[strings.Join(lvs, ",")]
+}
+
+// Keys returns the sorted labels with a value.
+func (m *Metric) Keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter returns the metric as a counter.
+func (m *Metric) Counter() metrics.Counter { return counter{m} }
+
+// Gauge returns the metric as a gauge.
+func (m *Metric) Gauge() metrics.Gauge { return gauge{m} }
+
+// Observer returns the metric as an observer counting the observations.
+func (m *Metric) Observer() metrics.Observer { return observer{m} }
+
+type counter struct{ *Metric }
+
+func (c counter) With(lvs ...string) metrics.Counter { return counter{c.with(lvs...)} }
+func (c counter) Inc()                               { c.add(1, false) }
+func (c counter) Add(v float64)                      { c.add(v, false) }
+
+type gauge struct{ *Metric }
+
+func (g gauge) With(lvs ...string) metrics.Gauge { return gauge{g.with(lvs...)} }
+func (g gauge) Set(v float64)                    { g.add(v, true) }
+func (g gauge) Add(v float64)                    { g.add(v, false) }
+func (g gauge) Sub(v float64)                    { g.add(-v, false) }
+
+type observer struct{ *Metric }
+
+func (o observer) With(lvs ...string) metrics.Observer { return observer{o.with(lvs...)} }
+func (o observer) Observe(float64)                     { o.add(1, false) }
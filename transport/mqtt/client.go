@@ -0,0 +1,485 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/encoding"
+	"github.com/go-kratos/kratos/v2/encoding/json"
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/transport"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// EncodeRequestFunc is request encode func.
+type EncodeRequestFunc func(ctx context.Context, in interface{}) ([]byte, error)
+
+// DecodeResponseFunc is response decode func.
+type DecodeResponseFunc func(ctx context.Context, data []byte, v interface{}) error
+
+// DecodeErrorFunc is decode error func.
+type DecodeErrorFunc func(ctx context.Context, data []byte) error
+
+// ClientOption is MQTT client option.
+type ClientOption func(*clientOptions)
+
+// WithBroker with mqtt client broker.
+func WithBroker(broker string) ClientOption {
+	return func(o *clientOptions) {
+		o.clientOption.AddBroker(broker)
+	}
+}
+
+// WithUsername with mqtt client username.
+func WithUsername(username string) ClientOption {
+	return func(o *clientOptions) {
+		o.clientOption.SetUsername(username)
+	}
+}
+
+// WithPassword with mqtt client password.
+func WithPassword(password string) ClientOption {
+	return func(o *clientOptions) {
+		o.clientOption.SetPassword(password)
+	}
+}
+
+// WithClientId with mqtt client clientId.
+func WithClientId(clientId string) ClientOption {
+	return func(o *clientOptions) {
+		o.clientOption.SetClientID(clientId)
+	}
+}
+
+// WithTimeout with client request timeout.
+func WithTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.timeout = d
+	}
+}
+
+// WithQos with client publish and reply subscribe qos.
+func WithQos(qos byte) ClientOption {
+	return func(o *clientOptions) {
+		o.qos = qos
+	}
+}
+
+// WithMiddleware with client middleware.
+func WithMiddleware(m ...middleware.Middleware) ClientOption {
+	return func(o *clientOptions) {
+		o.middleware = m
+	}
+}
+
+// WithRequestEncoder with client request encoder.
+func WithRequestEncoder(encoder EncodeRequestFunc) ClientOption {
+	return func(o *clientOptions) {
+		o.encoder = encoder
+	}
+}
+
+// WithResponseDecoder with client response decoder.
+func WithResponseDecoder(decoder DecodeResponseFunc) ClientOption {
+	return func(o *clientOptions) {
+		o.decoder = decoder
+	}
+}
+
+// WithErrorDecoder with client error decoder.
+func WithErrorDecoder(errorDecoder DecodeErrorFunc) ClientOption {
+	return func(o *clientOptions) {
+		o.errorDecoder = errorDecoder
+	}
+}
+
+// WithHeaderEncoder with client request header encoder.
+func WithHeaderEncoder(encoder EncodeHeaderFunc) ClientOption {
+	return func(o *clientOptions) {
+		o.headerEncoder = encoder
+	}
+}
+
+// WithProtocolVersion with mqtt protocol version, ProtocolVersionV5 correlates
+// replies by the response topic and correlation data of MQTT 5.
+func WithProtocolVersion(version uint) ClientOption {
+	return func(o *clientOptions) {
+		o.clientOption.SetProtocolVersion(version)
+		o.protocolVersion = version
+	}
+}
+
+// WithResponseTopic with mqtt v5 response topic, defaults to /reply/{clientId}.
+func WithResponseTopic(topic string) ClientOption {
+	return func(o *clientOptions) {
+		o.responseTopic = topic
+	}
+}
+
+// WithReplyTopicStrategy with the strategy deriving the reply topic the
+// MQTT 3 replies are expected on, defaults to DefaultReplyTopic.
+func WithReplyTopicStrategy(f ReplyTopicFunc) ClientOption {
+	return func(o *clientOptions) {
+		o.replyTopic = f
+	}
+}
+
+// WithRequestIDField with the field of the JSON request id MQTT 3 replies
+// are correlated by, defaults to id. A reply echoing the id is delivered to
+// its request, one without an id to the oldest request of its reply topic.
+// An empty field correlates the replies in order only.
+func WithRequestIDField(field string) ClientOption {
+	return func(o *clientOptions) {
+		o.requestIDField = field
+	}
+}
+
+// WithClientFactory with the factory of the paho client.
+func WithClientFactory(f ClientFactory) ClientOption {
+	return func(o *clientOptions) {
+		o.newClient = f
+	}
+}
+
+// WithLogger with client logger.
+func WithLogger(logger log.Logger) ClientOption {
+	return func(o *clientOptions) {
+		o.log = log.NewHelper(logger)
+	}
+}
+
+// clientOptions is the MQTT client options.
+type clientOptions struct {
+	clientOption    *pmqtt.ClientOptions
+	timeout         time.Duration
+	qos             byte
+	middleware      []middleware.Middleware
+	encoder         EncodeRequestFunc
+	decoder         DecodeResponseFunc
+	errorDecoder    DecodeErrorFunc
+	headerEncoder   EncodeHeaderFunc
+	protocolVersion uint
+	responseTopic   string
+	replyTopic      ReplyTopicFunc
+	requestIDField  string
+	newClient       ClientFactory
+	tracer          trace.Tracer
+	propagator      propagation.TextMapPropagator
+	log             *log.Helper
+}
+
+// Client is an MQTT request/reply client.
+type Client struct {
+	opts       clientOptions
+	endpoint   string
+	mqttClient pmqtt.Client
+
+	mu      sync.Mutex
+	seq     uint64
+	subs    map[string]bool
+	pending map[string][]*call
+}
+
+// call is a request waiting for its reply.
+type call struct {
+	id string
+	ch chan []byte
+}
+
+// NewClient returns an MQTT client and connects it to the broker.
+func NewClient(ctx context.Context, opts ...ClientOption) (*Client, error) {
+	options := clientOptions{
+		clientOption:   pmqtt.NewClientOptions(),
+		timeout:        5 * time.Second,
+		encoder:        DefaultRequestEncoder,
+		decoder:        DefaultResponseDecoder,
+		errorDecoder:   DefaultErrorDecoder,
+		replyTopic:     DefaultReplyTopic,
+		requestIDField: "id",
+		propagator:     defaultPropagator(),
+		log:            log.NewHelper(log.GetLogger()),
+	}
+	for _, o := range opts {
+		o(&options)
+	}
+	dialTimeout(options.clientOption)
+	c := &Client{
+		opts:    options,
+		subs:    make(map[string]bool),
+		pending: make(map[string][]*call),
+	}
+	if len(options.clientOption.Servers) > 0 {
+		c.endpoint = options.clientOption.Servers[0].Redacted()
+	}
+	// subscriptions are lost on a clean session reconnect
+	options.clientOption.SetOnConnectHandler(func(pmqtt.Client) {
+		c.mu.Lock()
+		c.subs = make(map[string]bool)
+		c.mu.Unlock()
+	})
+	switch {
+	case options.newClient != nil:
+		c.mqttClient = options.newClient(options.clientOption)
+	case options.protocolVersion == ProtocolVersionV5:
+		if c.opts.responseTopic == "" {
+			id := options.clientOption.ClientID
+			if id == "" {
+				b := make([]byte, 8)
+				_, _ = rand.Read(b)
+				id = hex.EncodeToString(b)
+			}
+			c.opts.responseTopic = "/reply/" + id
+		}
+		c.mqttClient = newV5Client(options.clientOption, 0)
+	default:
+		c.mqttClient = pmqtt.NewClient(options.clientOption)
+	}
+	if err := waitToken(ctx, c.mqttClient.Connect()); err != nil {
+		if ctx.Err() != nil {
+			// abort the connect still in progress
+			c.mqttClient.Disconnect(0)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// Invoke publishes args to the topic and waits for the reply on the reply topic.
+func (c *Client) Invoke(ctx context.Context, topic string, args interface{}, reply interface{}) error {
+	tr := &Transport{
+		endpoint:    c.endpoint,
+		operation:   topic,
+		topic:       topic,
+		reqHeader:   headerCarrier{},
+		replyHeader: headerCarrier{},
+	}
+	ctx = transport.NewClientContext(ctx, tr)
+	if c.opts.tracer != nil {
+		var span trace.Span
+		ctx, span = startProducerSpan(ctx, c.opts.tracer, c.opts.propagator, tr)
+		defer span.End()
+	}
+	h := func(ctx context.Context, in interface{}) (interface{}, error) {
+		if err := c.invoke(ctx, topic, in, reply); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	}
+	if len(c.opts.middleware) > 0 {
+		h = middleware.Chain(c.opts.middleware...)(h)
+	}
+	_, err := h(ctx, args)
+	spanError(ctx, err)
+	return err
+}
+
+func (c *Client) invoke(ctx context.Context, topic string, args interface{}, reply interface{}) error {
+	if _, ok := ctx.Deadline(); !ok && c.opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.timeout)
+		defer cancel()
+	}
+	body, err := c.opts.encoder(ctx, args)
+	if err != nil {
+		return err
+	}
+	var id string
+	if c.opts.requestIDField != "" {
+		id, _ = payloadID(body, c.opts.requestIDField)
+	}
+	tr, _ := transport.FromClientContext(ctx)
+	v5, isV5 := c.mqttClient.(*v5Client)
+	if tr != nil && !isV5 && c.opts.headerEncoder != nil {
+		if body, err = c.opts.headerEncoder(tr.RequestHeader(), body); err != nil {
+			return err
+		}
+	}
+	var (
+		cl    *call
+		key   string
+		token pmqtt.Token
+	)
+	c.opts.log.Debugf("[mqtt] client publish topic:%v,body: %v", topic, string(body))
+	if isV5 {
+		// MQTT 5 replies come back on the response topic with the correlation data
+		c.mu.Lock()
+		c.seq++
+		key = strconv.FormatUint(c.seq, 10)
+		c.mu.Unlock()
+		if cl, err = c.wait(ctx, c.opts.responseTopic, key, ""); err != nil {
+			return err
+		}
+		defer c.cancel(key, cl)
+		props := &paho.PublishProperties{
+			ResponseTopic:   c.opts.responseTopic,
+			CorrelationData: []byte(key),
+		}
+		if tr != nil {
+			for _, k := range tr.RequestHeader().Keys() {
+				props.User.Add(k, tr.RequestHeader().Get(k))
+			}
+		}
+		token = v5.PublishProperties(topic, c.opts.qos, false, body, props)
+	} else {
+		key = c.opts.replyTopic(topic)
+		if cl, err = c.wait(ctx, key, key, id); err != nil {
+			return err
+		}
+		defer c.cancel(key, cl)
+		token = c.mqttClient.Publish(topic, c.opts.qos, false, body)
+	}
+	if err = waitToken(ctx, token); err != nil {
+		return err
+	}
+	select {
+	case data := <-cl.ch:
+		if err = c.opts.errorDecoder(ctx, data); err != nil {
+			return err
+		}
+		return c.opts.decoder(ctx, data, reply)
+	case <-ctx.Done():
+		return contextError(ctx.Err())
+	}
+}
+
+// wait registers a pending call of the request id under the key, subscribing
+// to the reply topic if needed.
+func (c *Client) wait(ctx context.Context, replyTopic, key, id string) (*call, error) {
+	c.mu.Lock()
+	subscribed := c.subs[replyTopic]
+	c.mu.Unlock()
+	if !subscribed {
+		token := c.mqttClient.Subscribe(replyTopic, c.opts.qos, c.handleReply)
+		if err := waitToken(ctx, token); err != nil {
+			return nil, err
+		}
+	}
+	cl := &call{id: id, ch: make(chan []byte, 1)}
+	c.mu.Lock()
+	c.subs[replyTopic] = true
+	c.pending[key] = append(c.pending[key], cl)
+	c.mu.Unlock()
+	return cl, nil
+}
+
+func (c *Client) cancel(key string, cl *call) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	calls := c.pending[key]
+	for i, pending := range calls {
+		if pending == cl {
+			c.pending[key] = append(calls[:i], calls[i+1:]...)
+			break
+		}
+	}
+	if len(c.pending[key]) == 0 {
+		delete(c.pending, key)
+	}
+}
+
+// handleReply delivers a reply to the call of its correlation data in MQTT 5,
+// else to the call of the request id it echoes, or to the oldest pending call
+// of its topic without one.
+func (c *Client) handleReply(_ pmqtt.Client, msg pmqtt.Message) {
+	key, id := msg.Topic(), ""
+	if m, ok := msg.(PropertiesMessage); ok && m.Properties() != nil && len(m.Properties().CorrelationData) > 0 {
+		key = string(m.Properties().CorrelationData)
+	} else if c.opts.requestIDField != "" {
+		id, _ = payloadID(msg.Payload(), c.opts.requestIDField)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	calls := c.pending[key]
+	i := replyCall(calls, id)
+	if i < 0 {
+		c.opts.log.Debugf("[mqtt] client drop unexpected reply topic: %s", msg.Topic())
+		return
+	}
+	calls[i].ch <- msg.Payload()
+	c.pending[key] = append(calls[:i:i], calls[i+1:]...)
+}
+
+// replyCall returns the index of the call of the request id, the oldest call
+// without an id for an id matching none, or -1.
+func replyCall(calls []*call, id string) int {
+	if id == "" {
+		if len(calls) == 0 {
+			return -1
+		}
+		return 0
+	}
+	for i, cl := range calls {
+		if cl.id == id {
+			return i
+		}
+	}
+	for i, cl := range calls {
+		if cl.id == "" {
+			return i
+		}
+	}
+	return -1
+}
+
+// Close disconnects the client from the broker.
+func (c *Client) Close() error {
+	c.mqttClient.Disconnect(250)
+	return nil
+}
+
+// DefaultRequestEncoder is an MQTT request encoder.
+func DefaultRequestEncoder(ctx context.Context, in interface{}) ([]byte, error) {
+	return encoding.GetCodec(json.Name).Marshal(in)
+}
+
+// DefaultResponseDecoder is an MQTT response decoder.
+func DefaultResponseDecoder(ctx context.Context, data []byte, v interface{}) error {
+	if len(data) == 0 || v == nil {
+		return nil
+	}
+	return encoding.GetCodec(json.Name).Unmarshal(data, v)
+}
+
+// DefaultErrorDecoder is an MQTT error decoder.
+// The reply is treated as an error when it carries a non-2xx code, as
+// written by DefaultErrorEncoder.
+func DefaultErrorDecoder(ctx context.Context, data []byte) error {
+	var reply struct {
+		Code    int32  `json:"code"`
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	}
+	if err := encoding.GetCodec(json.Name).Unmarshal(data, &reply); err != nil {
+		return nil
+	}
+	if reply.Code == 0 || (reply.Code >= 200 && reply.Code <= 299) {
+		return nil
+	}
+	return errors.New(int(reply.Code), reply.Reason, reply.Message)
+}
+
+// waitToken waits for the token to complete or the context to be done.
+func waitToken(ctx context.Context, token pmqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return contextError(ctx.Err())
+	}
+}
+
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return errors.GatewayTimeout("TIMEOUT", err.Error())
+	}
+	return errors.ClientClosed("CANCELED", err.Error())
+}
@@ -1,22 +1,26 @@
 package mqtt
 
 import (
-	"fmt"
+	"context"
 	"strings"
+	"sync"
+	"time"
 
 	pmqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/go-kratos/kratos/v2/encoding"
 	"github.com/go-kratos/kratos/v2/encoding/json"
+	_ "github.com/go-kratos/kratos/v2/encoding/proto"
 	"github.com/go-kratos/kratos/v2/errors"
 	"github.com/go-kratos/kratos/v2/log"
 )
 
 // SupportPackageIsVersion1 These constants should not be referenced from any other code.
 const SupportPackageIsVersion1 = true
-const (
-	ServerTopicPrefix = "/sys"
-	DeviceTopicPrefix = "/device"
-)
+
+// SupportPackageIsVersion2 is referenced by the code of protoc-gen-go-mqtt
+// v2.1.0 and later, which uses SetOperation, RouteOption and the dead letter
+// reasons.
+const SupportPackageIsVersion2 = true
 
 // DecodeRequestFunc is decode request func.
 type DecodeRequestFunc func([]byte, interface{}) error
@@ -27,38 +31,65 @@ type EncodeResponseFunc func(c pmqtt.Client, topic string, v interface{}) error
 // EncodeErrorFunc is encode error func.
 type EncodeErrorFunc func(c pmqtt.Client, topic string, err error)
 
-// DefaultRequestDecoder decodes the request body to object.
+// DecodeRequestContextFunc is decode request func, ctx is the handler
+// context.
+type DecodeRequestContextFunc func(ctx context.Context, data []byte, v interface{}) error
+
+// EncodeResponseContextFunc is encode response func, ctx is the handler
+// context and topic the request topic.
+type EncodeResponseContextFunc func(ctx context.Context, c pmqtt.Client, topic string, v interface{}) error
+
+// EncodeErrorContextFunc is encode error func, ctx is the handler context and
+// topic the request topic. The error publishing the reply is returned.
+type EncodeErrorContextFunc func(ctx context.Context, c pmqtt.Client, topic string, err error) error
+
+// DefaultRequestDecoder decodes the JSON request body to object.
 func DefaultRequestDecoder(data []byte, v interface{}) error {
+	return DefaultRequestContextDecoder(context.Background(), data, v)
+}
+
+// DefaultResponseEncoder encodes the object to the JSON mqtt reply.
+func DefaultResponseEncoder(c pmqtt.Client, topic string, v interface{}) error {
+	return DefaultResponseContextEncoder(context.Background(), c, topic, v)
+}
+
+// DefaultErrorEncoder encodes the error to the JSON mqtt response.
+func DefaultErrorEncoder(c pmqtt.Client, topic string, err error) {
+	_ = DefaultErrorContextEncoder(context.Background(), c, topic, err)
+}
+
+// DefaultRequestContextDecoder decodes the request body to object with the
+// codec of the message, see CodecFromContext.
+func DefaultRequestContextDecoder(ctx context.Context, data []byte, v interface{}) error {
 	if len(data) == 0 {
 		return nil
 	}
-	codec := encoding.GetCodec(json.Name)
+	codec := CodecFromContext(ctx)
 	if err := codec.Unmarshal(data, v); err != nil {
 		return errors.BadRequest("CODEC", err.Error())
 	}
 	return nil
 }
 
-// DefaultResponseEncoder encodes the object to the mqtt reply.
-func DefaultResponseEncoder(c pmqtt.Client, topic string, v interface{}) error {
+// DefaultResponseContextEncoder encodes the object to the mqtt reply with the
+// codec of the request message, see RouteOmitRequestID.
+func DefaultResponseContextEncoder(ctx context.Context, c pmqtt.Client, topic string, v interface{}) error {
 	if v == nil {
 		return nil
 	}
-	codec := encoding.GetCodec(json.Name)
+	codec := CodecFromContext(ctx)
 	body, err := codec.Marshal(v)
 	if err != nil {
 		return err
 	}
-	replyTopic := makeReplyTopic(topic)
-	log.Debugf("reply mqtt topic:%v,body: %v", replyTopic, string(body))
-	if c != nil {
-		c.Publish(replyTopic, 0, false, body)
+	if body, err = encodeReplyHeader(ctx, echoRequestID(ctx, codec, body)); err != nil {
+		return err
 	}
-	return nil
+	return PublishReply(ctx, c, topic, body)
 }
 
-// DefaultErrorEncoder encodes the error to the mqtt response.
-func DefaultErrorEncoder(c pmqtt.Client, topic string, err error) {
+// DefaultErrorContextEncoder encodes the error to the mqtt response.
+func DefaultErrorContextEncoder(ctx context.Context, c pmqtt.Client, topic string, err error) error {
 	var reply struct {
 		Id      string `json:"id"`
 		Code    int32  `json:"code"`
@@ -67,26 +98,167 @@ func DefaultErrorEncoder(c pmqtt.Client, topic string, err error) {
 	}
 	se := errors.FromError(err)
 	reply.Id = se.Metadata["id"]
+	if reply.Id == "" {
+		reply.Id, _ = RequestIDFromContext(ctx)
+	}
 	reply.Code = se.Code
 	reply.Message = se.Message
 	reply.Reason = se.Reason
-	codec := encoding.GetCodec(json.Name)
-	body, _ := codec.Marshal(reply)
-	replyTopic := makeReplyTopic(topic)
+	body, err := CodecFromContext(ctx).Marshal(reply)
+	if err != nil {
+		// eg the proto codec only marshals proto messages
+		if body, err = encoding.GetCodec(json.Name).Marshal(reply); err != nil {
+			return err
+		}
+	}
+	if body, err = encodeReplyHeader(ctx, body); err != nil {
+		return err
+	}
+	return PublishReply(ctx, c, topic, body)
+}
+
+// ReplyTimeout with the time a handler waits for the broker to acknowledge
+// its reply, defaults to 10s.
+func ReplyTimeout(timeout time.Duration) ServerOption {
+	return func(o *Server) {
+		o.replyTimeout = timeout
+	}
+}
+
+type waitKey struct{}
+
+// publishWait is how a handler waits for the tokens of its publishes.
+type publishWait struct {
+	timeout time.Duration
+	// async is set on the paho callback goroutine of the ordered messages,
+	// which also reads the acknowledgements: waiting there deadlocks the
+	// connection, the token is waited for in the background.
+	async bool
+	log   *log.Helper
+	// pending tracks the tokens for Stop
+	pending *inflight
+}
+
+// newPublishWait returns the publish wait of the handlers, dispatched when
+// run on the Dispatcher workers.
+func (s *Server) newPublishWait(dispatched bool) *publishWait {
+	return &publishWait{
+		timeout: s.replyTimeout,
+		async:   !dispatched && s.clientOption.Order,
+		log:     s.log,
+		pending: &s.pending,
+	}
+}
+
+// waitPublish waits for the publish token of the handler in ctx, bounded by
+// the reply timeout. Outside a handler it waits until the ctx is done.
+func waitPublish(ctx context.Context, topic string, token pmqtt.Token) error {
+	w, ok := ctx.Value(waitKey{}).(*publishWait)
+	if !ok {
+		return waitToken(ctx, token)
+	}
+	w.pending.track(token)
+	if w.async {
+		go func() {
+			if !token.WaitTimeout(w.timeout) {
+				w.log.Errorf("[mqtt] publish topic: %s error(timeout after %v)", topic, w.timeout)
+			} else if err := token.Error(); err != nil {
+				w.log.Errorf("[mqtt] publish topic: %s error(%v)", topic, err)
+			}
+		}()
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	return waitToken(ctx, token)
+}
+
+// PublishReply publishes the reply body of the request topic with the reply
+// options of the route. A handler waits for the broker up to the reply
+// timeout, on the paho callback goroutine of the ordered messages it does not
+// wait and the publish error is logged.
+func PublishReply(ctx context.Context, c pmqtt.Client, topic string, body []byte) error {
+	o := ReplyOptionsFromContext(ctx)
+	replyTopic := o.Topic
+	if replyTopic == "" && o.TopicFunc != nil {
+		replyTopic = o.TopicFunc(topic)
+	}
+	if replyTopic == "" {
+		replyTopic = DefaultReplyTopic(topic)
+	}
 	log.Debugf("reply mqtt topic:%v,body: %v", replyTopic, string(body))
-	if c != nil {
-		c.Publish(replyTopic, 0, false, body)
+	if c == nil {
+		return nil
 	}
+	return waitPublish(ctx, replyTopic, c.Publish(replyTopic, o.Qos, o.Retain, body))
 }
 
-func makeReplyTopic(topic string) string {
-	replyTopic := topic
-	if strings.HasPrefix(topic, ServerTopicPrefix) {
-		replyTopic = strings.TrimPrefix(topic, ServerTopicPrefix)
-		replyTopic = fmt.Sprintf("%s%s_reply", DeviceTopicPrefix, replyTopic)
-	} else if strings.HasPrefix(topic, DeviceTopicPrefix) {
-		replyTopic = strings.TrimPrefix(topic, DeviceTopicPrefix)
-		replyTopic = fmt.Sprintf("%s%s_reply", ServerTopicPrefix, replyTopic)
+// codecAliases maps content subtypes and topic suffixes to codec names.
+var codecAliases = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: map[string]string{
+	"pb":         "proto",
+	"protobuf":   "proto",
+	"x-protobuf": "proto",
+}}
+
+// RegisterCodec registers the codec to kratos encoding, and its aliases, eg
+// content subtypes or topic suffixes, so it is picked for the MQTT messages.
+func RegisterCodec(codec encoding.Codec, aliases ...string) {
+	encoding.RegisterCodec(codec)
+	codecAliases.Lock()
+	defer codecAliases.Unlock()
+	for _, alias := range aliases {
+		codecAliases.m[strings.ToLower(alias)] = codec.Name()
+	}
+}
+
+// GetCodec returns the codec registered with the name or alias.
+func GetCodec(name string) encoding.Codec {
+	name = strings.ToLower(name)
+	codecAliases.RLock()
+	if n, ok := codecAliases.m[name]; ok {
+		name = n
+	}
+	codecAliases.RUnlock()
+	return encoding.GetCodec(name)
+}
+
+type codecKey struct{}
+
+// CodecFromContext returns the codec of the message handled in ctx, json by
+// default.
+func CodecFromContext(ctx context.Context) encoding.Codec {
+	if codec, ok := ctx.Value(codecKey{}).(encoding.Codec); ok {
+		return codec
+	}
+	return encoding.GetCodec(json.Name)
+}
+
+// messageCodec returns the codec of the message picked from the MQTT v5
+// content type, the last topic level, eg /json or /pb, when suffix is set,
+// then the route codec.
+func messageCodec(msg pmqtt.Message, route string, suffix bool) encoding.Codec {
+	if m, ok := msg.(PropertiesMessage); ok && m.Properties() != nil {
+		if subtype := contentSubtype(m.Properties().ContentType); subtype != "" {
+			if codec := GetCodec(subtype); codec != nil {
+				return codec
+			}
+		}
+	}
+	if suffix {
+		topic := msg.Topic()
+		if i := strings.LastIndexByte(topic, '/'); i >= 0 {
+			if codec := GetCodec(topic[i+1:]); codec != nil {
+				return codec
+			}
+		}
+	}
+	if route != "" {
+		if codec := GetCodec(route); codec != nil {
+			return codec
+		}
 	}
-	return replyTopic
+	return encoding.GetCodec(json.Name)
 }
@@ -4,6 +4,8 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/eclipse/paho.golang/paho"
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/go-kratos/kratos/v2/errors"
 )
 
@@ -54,3 +56,65 @@ func TestDefaultResponseEncoderEncodeNil(t *testing.T) {
 		t.Errorf("expected no error, got %v", err)
 	}
 }
+
+// testCodec is a codec registered under a name not known to kratos.
+type testCodec struct{}
+
+func (testCodec) Marshal(v interface{}) ([]byte, error) { return []byte("cbor"), nil }
+func (testCodec) Unmarshal(data []byte, v interface{}) error {
+	*(v.(*string)) = string(data)
+	return nil
+}
+func (testCodec) Name() string { return "x-test-cbor" }
+
+func TestMessageCodec(t *testing.T) {
+	RegisterCodec(testCodec{}, "cbor", "application/cbor")
+	tests := []struct {
+		msg    pmqtt.Message
+		route  string
+		suffix bool
+		want   string
+	}{
+		{&testMessage{topic: "/sys/pk/dn/thing/event/post"}, "", false, "json"},
+		{&testMessage{topic: "/sys/pk/dn/thing/event/post"}, "pb", false, "proto"},
+		{&testMessage{topic: "/sys/pk/dn/thing/event/post/pb"}, "", true, "proto"},
+		{&testMessage{topic: "/sys/pk/dn/thing/event/post/cbor"}, "json", true, "x-test-cbor"},
+		// a device named pb
+		{&testMessage{topic: "/sys/pk/pb"}, "", false, "json"},
+		{&v5Message{p: &paho.Publish{
+			Topic:      "/sys/pk/dn/thing/event/post/json",
+			Properties: &paho.PublishProperties{ContentType: "application/cbor"},
+		}}, "", true, "x-test-cbor"},
+		{&v5Message{p: &paho.Publish{
+			Topic:      "/sys/pk/dn/thing/event/post",
+			Properties: &paho.PublishProperties{ContentType: "application/unknown"},
+		}}, "", false, "json"},
+	}
+	for _, tt := range tests {
+		if got := messageCodec(tt.msg, tt.route, tt.suffix).Name(); got != tt.want {
+			t.Errorf("codec of %s: expected %s, got %s", tt.msg.Topic(), tt.want, got)
+		}
+	}
+}
+
+func TestRouteCodec(t *testing.T) {
+	srv := NewServer()
+	c := &testClient{connected: true}
+	var got string
+	srv.Route().Handle("/sys/:pk/:dn/thing/event/post", func(ctx Context) {
+		if err := ctx.Bind(&got); err != nil {
+			t.Error(err)
+		}
+		if err := ctx.Reply(&got); err != nil {
+			t.Error(err)
+		}
+	}, RouteCodec("cbor"))
+	RegisterCodec(testCodec{}, "cbor")
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/event/post", payload: []byte("in")})
+	if got != "in" {
+		t.Errorf("expected bound with route codec, got %q", got)
+	}
+	if len(c.pubs) != 1 || string(c.pubs[0].payload) != "cbor" {
+		t.Errorf("expected reply with route codec, got %v", c.pubs)
+	}
+}
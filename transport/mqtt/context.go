@@ -8,12 +8,17 @@ import (
 	"github.com/bytectl/gopkg/transport/mqtt/mux"
 	pmqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/transport"
 	"github.com/go-kratos/kratos/v2/transport/http/binding"
 )
 
 var _ Context = (*wrapper)(nil)
 
 // Context is an MQTT Context.
+//
+// Since SupportPackageIsVersion2 ReplyErr returns the error publishing the
+// reply and DeadLetter is added, an implementation outside this package must
+// be updated.
 type Context interface {
 	context.Context
 	Client() pmqtt.Client
@@ -23,7 +28,8 @@ type Context interface {
 	Bind(v interface{}) error
 	BindVars(v interface{}) error
 	Reply(v interface{}) error
-	ReplyErr(err error)
+	ReplyErr(err error) error
+	DeadLetter(reason string, err error)
 }
 
 type wrapper struct {
@@ -37,7 +43,17 @@ type wrapper struct {
 func (c *wrapper) Client() pmqtt.Client   { return c.client }
 func (c *wrapper) Message() pmqtt.Message { return c.msg }
 func (c *wrapper) Middleware(h middleware.Handler) middleware.Handler {
-	return middleware.Chain(c.router.srv.ms...)(h)
+	next := func(ctx context.Context, req interface{}) (interface{}, error) {
+		// hand the handler a Context carrying the values added by middleware
+		w := *c
+		w.ctx = ctx
+		return h(&w, req)
+	}
+	ms := c.router.srv.ms
+	if route, ok := c.Value(routeKey{}).(*routeOptions); ok {
+		ms = route.ms
+	}
+	return middleware.Chain(ms...)(next)
 }
 func (c *wrapper) Reset(ctx context.Context, client pmqtt.Client, msg pmqtt.Message, ps *mux.Params) {
 	c.ctx = ctx
@@ -78,9 +94,13 @@ type paramsKey struct{}
 
 var pKey = paramsKey{}
 
-func (c *wrapper) Bind(v interface{}) error { return c.router.srv.dec(c.Message().Payload(), v) }
+func (c *wrapper) Bind(v interface{}) error { return c.router.srv.dec(c, c.Message().Payload(), v) }
 
 func (c *wrapper) BindVars(v interface{}) error {
+	if c.ps == nil {
+		// a route without params
+		return nil
+	}
 	varValues := make(url.Values)
 	for _, p := range *c.ps {
 		if p.Key == "" {
@@ -92,8 +112,39 @@ func (c *wrapper) BindVars(v interface{}) error {
 }
 
 func (c *wrapper) Reply(v interface{}) error {
-	return c.router.srv.enc(c.client, c.Message().Topic(), v)
+	err := c.router.srv.enc(c, c.replyClient(), c.Message().Topic(), v)
+	if err != nil {
+		setStatus(c, StatusFailed, err)
+	} else {
+		setStatus(c, StatusReplied, nil)
+	}
+	return err
+}
+func (c *wrapper) ReplyErr(err error) error {
+	setStatus(c, StatusFailed, err)
+	return c.router.srv.ene(c, c.replyClient(), c.Message().Topic(), err)
 }
-func (c *wrapper) ReplyErr(err error) {
-	c.router.srv.ene(c.client, c.Message().Topic(), err)
+
+// DeadLetter sends the message to the dead letter sink of the server.
+func (c *wrapper) DeadLetter(reason string, err error) {
+	c.router.srv.sendDeadLetter(c, c.msg, reason, err)
+}
+
+// replyClient returns the client the reply is published with, an MQTT v5
+// reply carries the reply header as user properties and a request carrying a
+// response topic is answered on that topic.
+func (c *wrapper) replyClient() pmqtt.Client {
+	v5, ok := c.client.(*v5Client)
+	if !ok {
+		return c.client
+	}
+	rc := &responseClient{v5Client: v5}
+	if m, ok := c.msg.(PropertiesMessage); ok && m.Properties() != nil {
+		rc.responseTopic = m.Properties().ResponseTopic
+		rc.correlationData = m.Properties().CorrelationData
+	}
+	if tr, ok := transport.FromServerContext(c); ok {
+		rc.header = tr.ReplyHeader()
+	}
+	return rc
 }
@@ -0,0 +1,186 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// The reasons of the dead letters.
+const (
+	ReasonNotFound = "not_found"
+	ReasonDecode   = "decode"
+	ReasonValidate = "validate"
+	ReasonPanic    = "panic"
+	// ReasonOverflow is a message dropped by the Dispatcher, its queue full
+	// with OverflowDrop or the dispatcher closed.
+	ReasonOverflow = "overflow"
+)
+
+// DeadLetter is a message that could not be handled.
+type DeadLetter struct {
+	Topic   string
+	Payload []byte
+	Reason  string
+	Err     error
+	Time    time.Time
+}
+
+// DeadLetterSink receives the dead letters.
+type DeadLetterSink interface {
+	Send(ctx context.Context, dl *DeadLetter) error
+}
+
+// DeadLetterFunc is a DeadLetterSink callback.
+type DeadLetterFunc func(ctx context.Context, dl *DeadLetter) error
+
+// Send calls f(ctx, dl).
+func (f DeadLetterFunc) Send(ctx context.Context, dl *DeadLetter) error {
+	return f(ctx, dl)
+}
+
+// DeadLetterQueue with the dead letter sink.
+func DeadLetterQueue(sink DeadLetterSink) ServerOption {
+	return func(o *Server) {
+		o.deadLetter = sink
+	}
+}
+
+// DeadLetterTopic publishes the dead letters to the topic with the server
+// client, as JSON with the topic, payload, reason and error. It waits for the
+// broker like a reply, see PublishReply.
+func DeadLetterTopic(topic string, qos byte) ServerOption {
+	return func(o *Server) {
+		o.deadLetter = DeadLetterFunc(func(ctx context.Context, dl *DeadLetter) error {
+			body, err := json.Marshal(newDeadLetterRecord(dl))
+			if err != nil {
+				return err
+			}
+			return waitPublish(ctx, topic, o.mqttClient.Publish(topic, qos, false, body))
+		})
+	}
+}
+
+// DeadLetterLogInterval with the interval the dead letters of a reason are
+// logged at most once in, defaults to a second.
+func DeadLetterLogInterval(interval time.Duration) ServerOption {
+	return func(o *Server) {
+		o.deadLetterLog.interval = interval
+	}
+}
+
+// FileDeadLetterSink appends the dead letters to a file as JSON lines.
+type FileDeadLetterSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileDeadLetterSink opens the file to append the dead letters to.
+func NewFileDeadLetterSink(name string) (*FileDeadLetterSink, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterSink{file: file}, nil
+}
+
+// Send appends the dead letter to the file.
+func (s *FileDeadLetterSink) Send(_ context.Context, dl *DeadLetter) error {
+	body, err := json.Marshal(newDeadLetterRecord(dl))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(body, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (s *FileDeadLetterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+type deadLetterRecord struct {
+	Topic   string    `json:"topic"`
+	Payload []byte    `json:"payload"`
+	Reason  string    `json:"reason"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+func newDeadLetterRecord(dl *DeadLetter) *deadLetterRecord {
+	r := &deadLetterRecord{Topic: dl.Topic, Payload: dl.Payload, Reason: dl.Reason, Time: dl.Time}
+	if dl.Err != nil {
+		r.Error = dl.Err.Error()
+	}
+	return r
+}
+
+// callbackContext returns the context of the messages handled outside a
+// route, on the paho callback goroutine.
+func (s *Server) callbackContext() context.Context {
+	return context.WithValue(context.Background(), waitKey{}, s.callbackWait)
+}
+
+// sendDeadLetter logs the dead letter, rate limited per reason, and sends it
+// to the dead letter sink.
+func (s *Server) sendDeadLetter(ctx context.Context, msg pmqtt.Message, reason string, err error) {
+	if err != nil {
+		setStatus(ctx, StatusFailed, err)
+	} else {
+		setStatus(ctx, StatusFailed, errors.New(reason))
+	}
+	dl := &DeadLetter{
+		Topic:   msg.Topic(),
+		Payload: msg.Payload(),
+		Reason:  reason,
+		Err:     err,
+		Time:    time.Now(),
+	}
+	if ok, suppressed := s.deadLetterLog.allow(reason); ok {
+		s.log.Errorf("[mqtt] dead letter topic: %s, reason: %s, error(%v), %d suppressed", dl.Topic, reason, err, suppressed)
+	}
+	if s.deadLetter == nil {
+		return
+	}
+	if err := s.deadLetter.Send(ctx, dl); err != nil {
+		if ok, suppressed := s.deadLetterLog.allow("sink"); ok {
+			s.log.Errorf("[mqtt] dead letter sink topic: %s error(%v), %d suppressed", dl.Topic, err, suppressed)
+		}
+	}
+}
+
+// logLimiter allows a log of a key once per interval and counts the
+// suppressed ones.
+type logLimiter struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+func (l *logLimiter) allow(key string) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+		l.suppressed = make(map[string]int)
+	}
+	now := time.Now()
+	if last, ok := l.last[key]; ok && now.Sub(last) < l.interval {
+		l.suppressed[key]++
+		return false, 0
+	}
+	suppressed := l.suppressed[key]
+	l.last[key] = now
+	l.suppressed[key] = 0
+	return true, suppressed
+}
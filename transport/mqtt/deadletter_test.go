@@ -0,0 +1,124 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterNotFound(t *testing.T) {
+	var got []*DeadLetter
+	srv := NewServer(DeadLetterQueue(DeadLetterFunc(func(ctx context.Context, dl *DeadLetter) error {
+		got = append(got, dl)
+		return nil
+	})))
+	srv.Route().Handle("/sys/:pk/:dn/thing/event/post", func(ctx Context) {
+		ctx.DeadLetter(ReasonDecode, errors.New("bad payload"))
+	})
+	srv.router.ServeMQTT(nil, &testMessage{topic: "/unknown/topic", payload: []byte("x")})
+	srv.router.ServeMQTT(nil, &testMessage{topic: "/sys/pk/dn/thing/event/post", payload: []byte("y")})
+	if len(got) != 2 {
+		t.Fatalf("expected 2 dead letters, got %v", got)
+	}
+	if got[0].Topic != "/unknown/topic" || got[0].Reason != ReasonNotFound || string(got[0].Payload) != "x" {
+		t.Errorf("unexpected dead letter %+v", got[0])
+	}
+	if got[1].Reason != ReasonDecode || got[1].Err == nil || string(got[1].Payload) != "y" {
+		t.Errorf("unexpected dead letter %+v", got[1])
+	}
+}
+
+func TestDeadLetterTopic(t *testing.T) {
+	srv := NewServer(DeadLetterTopic("/dlq", 1))
+	c := &testClient{connected: true}
+	srv.mqttClient = c
+	srv.router.ServeMQTT(c, &testMessage{topic: "/unknown/topic", payload: []byte("x")})
+	if len(c.pubs) != 1 || c.pubs[0].topic != "/dlq" || c.pubs[0].qos != 1 {
+		t.Fatalf("expected dead letter published, got %v", c.pubs)
+	}
+	var record deadLetterRecord
+	if err := json.Unmarshal(c.pubs[0].payload, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Topic != "/unknown/topic" || record.Reason != ReasonNotFound || string(record.Payload) != "x" {
+		t.Errorf("unexpected record %+v", record)
+	}
+}
+
+func TestDeadLetterTopicPending(t *testing.T) {
+	srv := NewServer(DeadLetterTopic("/dlq", 1))
+	c := &testClient{connected: true, hang: true}
+	srv.mqttClient = c
+	done := make(chan struct{})
+	go func() {
+		srv.router.ServeMQTT(c, &testMessage{topic: "/unknown/topic"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the dead letter publish not to block the callback")
+	}
+	if len(c.pubs) != 1 {
+		t.Errorf("expected dead letter published, got %v", c.pubs)
+	}
+}
+
+func TestFileDeadLetterSink(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "dlq.log")
+	sink, err := NewFileDeadLetterSink(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		dl := &DeadLetter{Topic: "/t", Payload: []byte("p"), Reason: ReasonValidate, Err: errors.New("invalid")}
+		if err = sink.Send(context.Background(), dl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record deadLetterRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Error != "invalid" || record.Reason != ReasonValidate {
+			t.Errorf("unexpected record %+v", record)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("expected 2 lines, got %d", lines)
+	}
+}
+
+func TestLogLimiter(t *testing.T) {
+	l := logLimiter{interval: time.Hour}
+	if ok, _ := l.allow("a"); !ok {
+		t.Fatal("expected first log allowed")
+	}
+	if ok, _ := l.allow("a"); ok {
+		t.Fatal("expected second log suppressed")
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Fatal("expected other key allowed")
+	}
+	l.interval = 0
+	if ok, suppressed := l.allow("a"); !ok || suppressed != 1 {
+		t.Errorf("expected allowed with 1 suppressed, got %v %d", ok, suppressed)
+	}
+}
@@ -0,0 +1,265 @@
+package mqtt
+
+import (
+	"context"
+	"hash/fnv"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bytectl/gopkg/transport/mqtt/mux"
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-kratos/kratos/v2/metrics"
+)
+
+var _ mux.Dispatcher = (*Dispatcher)(nil)
+
+// KeyFunc returns the ordering key of a message, the messages of a key are
+// handled one at a time in arrival order.
+type KeyFunc func(msg pmqtt.Message, ps *mux.Params) string
+
+// TopicKey orders the messages per topic.
+func TopicKey(msg pmqtt.Message, _ *mux.Params) string {
+	return msg.Topic()
+}
+
+// ParamKey orders the messages per value of the topic param, eg ParamKey("dn")
+// for the route /sys/:pk/:dn/thing/event/post orders per device.
+func ParamKey(name string) KeyFunc {
+	return func(_ pmqtt.Message, ps *mux.Params) string {
+		if ps == nil {
+			return ""
+		}
+		return ps.ByName(name)
+	}
+}
+
+// OverflowPolicy is the policy applied to a message when its queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the mqtt client until the queue has room, which
+	// applies backpressure to the broker.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop drops the message, it is sent to the dead letter sink of
+	// the server with ReasonOverflow.
+	OverflowDrop
+)
+
+// DispatcherOption is a dispatcher option.
+type DispatcherOption func(*Dispatcher)
+
+// Workers with the number of handler goroutines, defaults to GOMAXPROCS.
+func Workers(n int) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.workers = n
+	}
+}
+
+// QueueSize with the queue length limit of a worker.
+func QueueSize(n int) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.queueSize = n
+	}
+}
+
+// OrderKey with the ordering key of messages. Without it the messages are
+// handled by the first free worker, in no particular order.
+func OrderKey(key KeyFunc) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.key = key
+	}
+}
+
+// Overflow with the policy applied when a queue is full.
+func Overflow(policy OverflowPolicy) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.overflow = policy
+	}
+}
+
+// QueueDepth with the gauge of queued messages.
+func QueueDepth(g metrics.Gauge) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.depthGauge = g
+	}
+}
+
+// Dropped with the counter of messages dropped on overflow.
+func Dropped(c metrics.Counter) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.dropped = c
+	}
+}
+
+// DispatcherLogger with dispatcher logger.
+func DispatcherLogger(logger log.Logger) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.log = log.NewHelper(logger)
+	}
+}
+
+type job struct {
+	h   mux.HandlerFunc
+	c   pmqtt.Client
+	msg pmqtt.Message
+	ps  *mux.Params
+}
+
+// Dispatcher runs the MQTT handlers on a bounded worker pool.
+//
+// The client acknowledges a QoS 1 or 2 message once it is queued, not once
+// it is handled: the dispatched messages are delivered at most once, the
+// queued ones are lost on a crash and not redelivered by the broker.
+type Dispatcher struct {
+	workers    int
+	queueSize  int
+	key        KeyFunc
+	overflow   OverflowPolicy
+	depthGauge metrics.Gauge
+	dropped    metrics.Counter
+	log        *log.Helper
+	// onDrop is set by the server to send the dropped messages to its dead
+	// letter sink.
+	onDrop func(msg pmqtt.Message, reason string)
+
+	queues  []chan job
+	depth   int64
+	wg      sync.WaitGroup
+	once    sync.Once
+	mu      sync.RWMutex
+	closed  bool
+	done    chan struct{}  // closed by Close, unblocks the pending senders
+	senders sync.WaitGroup // the Dispatch calls sending to a queue
+}
+
+// NewDispatcher creates a dispatcher and starts its workers.
+func NewDispatcher(opts ...DispatcherOption) *Dispatcher {
+	d := &Dispatcher{
+		workers:   runtime.GOMAXPROCS(0),
+		queueSize: 1024,
+		log:       log.NewHelper(log.GetLogger()),
+		done:      make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(d)
+	}
+	if d.workers < 1 {
+		d.workers = 1
+	}
+	if d.key == nil {
+		// a single queue shared by all workers
+		q := make(chan job, d.queueSize)
+		d.queues = []chan job{q}
+		for i := 0; i < d.workers; i++ {
+			d.wg.Add(1)
+			go d.work(q)
+		}
+		return d
+	}
+	// a queue per worker, a key always goes to the same worker
+	d.queues = make([]chan job, d.workers)
+	for i := range d.queues {
+		d.queues[i] = make(chan job, d.queueSize)
+		d.wg.Add(1)
+		go d.work(d.queues[i])
+	}
+	return d
+}
+
+// Dispatch queues the handler of a message. With OverflowBlock it blocks
+// until the queue has room or the dispatcher is closed.
+func (d *Dispatcher) Dispatch(h mux.HandlerFunc, c pmqtt.Client, msg pmqtt.Message, ps *mux.Params) {
+	d.mu.RLock()
+	if d.closed {
+		d.mu.RUnlock()
+		d.drop(msg, "dispatcher closed")
+		return
+	}
+	// the queues are closed once the senders are done
+	d.senders.Add(1)
+	d.mu.RUnlock()
+	defer d.senders.Done()
+
+	q := d.queues[0]
+	if len(d.queues) > 1 {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(d.key(msg, ps)))
+		q = d.queues[hash.Sum32()%uint32(len(d.queues))]
+	}
+	j := job{h: h, c: c, msg: msg, ps: ps}
+	d.setDepth(atomic.AddInt64(&d.depth, 1))
+	if d.overflow == OverflowDrop {
+		select {
+		case q <- j:
+		default:
+			d.setDepth(atomic.AddInt64(&d.depth, -1))
+			d.drop(msg, "queue full")
+		}
+		return
+	}
+	select {
+	case q <- j:
+	case <-d.done:
+		d.setDepth(atomic.AddInt64(&d.depth, -1))
+		d.drop(msg, "dispatcher closed")
+	}
+}
+
+// Len returns the number of queued messages.
+func (d *Dispatcher) Len() int {
+	return int(atomic.LoadInt64(&d.depth))
+}
+
+// Close stops accepting messages and waits for the queued ones to be
+// handled until the ctx is done.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.once.Do(func() {
+		d.mu.Lock()
+		d.closed = true
+		close(d.done)
+		d.mu.Unlock()
+		go func() {
+			d.senders.Wait()
+			for _, q := range d.queues {
+				close(q)
+			}
+		}()
+	})
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Dispatcher) work(q chan job) {
+	defer d.wg.Done()
+	for j := range q {
+		d.setDepth(atomic.AddInt64(&d.depth, -1))
+		j.h(j.c, j.msg, j.ps)
+	}
+}
+
+func (d *Dispatcher) drop(msg pmqtt.Message, reason string) {
+	if d.dropped != nil {
+		d.dropped.With(reason).Inc()
+	}
+	d.log.Warnf("[mqtt] dispatcher drop message topic: %s, %s", msg.Topic(), reason)
+	if d.onDrop != nil {
+		d.onDrop(msg, reason)
+	}
+}
+
+func (d *Dispatcher) setDepth(depth int64) {
+	if d.depthGauge != nil {
+		d.depthGauge.Set(float64(depth))
+	}
+}
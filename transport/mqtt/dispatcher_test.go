@@ -0,0 +1,167 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bytectl/gopkg/transport/mqtt/mux"
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/transport"
+)
+
+func TestDispatcherOrderKey(t *testing.T) {
+	d := NewDispatcher(Workers(4), OrderKey(ParamKey("dn")))
+	var (
+		mu  sync.Mutex
+		got = make(map[string][]string)
+	)
+	h := func(c pmqtt.Client, msg pmqtt.Message, ps *mux.Params) {
+		mu.Lock()
+		got[ps.ByName("dn")] = append(got[ps.ByName("dn")], string(msg.Payload()))
+		mu.Unlock()
+	}
+	for i := 0; i < 100; i++ {
+		dn := fmt.Sprintf("d%d", i%3)
+		d.Dispatch(h, nil, &testMessage{payload: []byte(fmt.Sprint(i))}, &mux.Params{{Key: "dn", Value: dn}})
+	}
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for dn, payloads := range got {
+		for i := 1; i < len(payloads); i++ {
+			var prev, cur int
+			fmt.Sscan(payloads[i-1], &prev)
+			fmt.Sscan(payloads[i], &cur)
+			if prev >= cur {
+				t.Fatalf("messages of %s out of order: %v", dn, payloads)
+			}
+		}
+	}
+	if d.Len() != 0 {
+		t.Errorf("expected empty queue, got %d", d.Len())
+	}
+}
+
+func TestDispatcherOverflowDrop(t *testing.T) {
+	d := NewDispatcher(Workers(1), QueueSize(1), Overflow(OverflowDrop))
+	block := make(chan struct{})
+	var (
+		mu      sync.Mutex
+		handled int
+	)
+	h := func(c pmqtt.Client, msg pmqtt.Message, ps *mux.Params) {
+		<-block
+		mu.Lock()
+		handled++
+		mu.Unlock()
+	}
+	for i := 0; i < 10; i++ {
+		d.Dispatch(h, nil, &testMessage{topic: "/t"}, nil)
+	}
+	close(block)
+	_ = d.Close(context.Background())
+	// at most one running and one queued message are kept
+	if handled < 1 || handled > 2 {
+		t.Errorf("expected the overflow dropped, handled %d", handled)
+	}
+}
+
+func TestDispatcherOverflowDeadLetter(t *testing.T) {
+	d := NewDispatcher(Workers(1), QueueSize(1), Overflow(OverflowDrop))
+	var (
+		mu      sync.Mutex
+		letters []string
+	)
+	srv := NewServer(
+		MessageDispatcher(d),
+		DeadLetterQueue(DeadLetterFunc(func(ctx context.Context, dl *DeadLetter) error {
+			mu.Lock()
+			letters = append(letters, dl.Reason+" "+dl.Err.Error())
+			mu.Unlock()
+			return nil
+		})),
+	)
+	started, block := make(chan struct{}, 3), make(chan struct{})
+	srv.Route().Handle("/sys/:pk/:dn/:event", func(ctx Context) {
+		started <- struct{}{}
+		<-block
+	})
+	// one running, one queued, the third is dropped
+	srv.router.ServeMQTT(nil, &testMessage{topic: "/sys/p1/d1/post"})
+	<-started
+	srv.router.ServeMQTT(nil, &testMessage{topic: "/sys/p1/d1/post"})
+	srv.router.ServeMQTT(nil, &testMessage{topic: "/sys/p1/d1/post"})
+	close(block)
+	_ = d.Close(context.Background())
+	// dropped after close
+	srv.router.ServeMQTT(nil, &testMessage{topic: "/sys/p1/d1/post"})
+	want := []string{"overflow queue full", "overflow dispatcher closed"}
+	if !reflect.DeepEqual(letters, want) {
+		t.Errorf("expected %v, got %v", want, letters)
+	}
+}
+
+func TestDispatcherPanic(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		reasons []string
+	)
+	d := NewDispatcher(Workers(2))
+	srv := NewServer(
+		MessageDispatcher(d),
+		HeaderDecoder(func(msg pmqtt.Message, header transport.Header) {
+			if msg.Topic() == "/sys/p1/d1/header" {
+				panic("bad header")
+			}
+		}),
+		DeadLetterQueue(DeadLetterFunc(func(ctx context.Context, dl *DeadLetter) error {
+			mu.Lock()
+			reasons = append(reasons, dl.Topic+" "+dl.Reason)
+			mu.Unlock()
+			return nil
+		})),
+	)
+	srv.Route().Handle("/sys/:pk/:dn/:event", func(ctx Context) {
+		panic("oops")
+	})
+	srv.router.ServeMQTT(nil, &testMessage{topic: "/sys/p1/d1/header"})
+	srv.router.ServeMQTT(nil, &testMessage{topic: "/sys/p1/d1/post"})
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(reasons)
+	want := []string{"/sys/p1/d1/header panic", "/sys/p1/d1/post panic"}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("expected %v, got %v", want, reasons)
+	}
+}
+
+func TestDispatcherCloseBlocked(t *testing.T) {
+	d := NewDispatcher(Workers(1), QueueSize(1))
+	block := make(chan struct{})
+	defer close(block)
+	h := func(c pmqtt.Client, msg pmqtt.Message, ps *mux.Params) { <-block }
+	// one running, one queued, the third blocks on the full queue
+	d.Dispatch(h, nil, &testMessage{topic: "/t"}, nil)
+	d.Dispatch(h, nil, &testMessage{topic: "/t"}, nil)
+	blocked := make(chan struct{})
+	go func() {
+		d.Dispatch(h, nil, &testMessage{topic: "/t"}, nil)
+		close(blocked)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the close deadline, got %v", err)
+	}
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("expected the blocked dispatch released by close")
+	}
+}
@@ -0,0 +1,115 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bytectl/gopkg/tsl"
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/encoding"
+	kjson "github.com/go-kratos/kratos/v2/encoding/json"
+	"github.com/go-kratos/kratos/v2/errors"
+)
+
+// EnvelopeMode with the tsl.EntityRequest/EntityReply envelope: the request
+// params are bound to the handler request and the reply is wrapped in an
+// EntityReply carrying the request id and method.
+func EnvelopeMode() ServerOption {
+	return func(o *Server) {
+		o.envelope = true
+		o.dec = EnvelopeRequestDecoder
+		o.enc = EnvelopeResponseEncoder
+		o.ene = EnvelopeErrorEncoder
+	}
+}
+
+type entityRequestKey struct{}
+
+// EntityRequestFromContext returns the envelope of the request handled in
+// ctx, set in envelope mode.
+func EntityRequestFromContext(ctx context.Context) (*tsl.EntityRequest, bool) {
+	req, ok := ctx.Value(entityRequestKey{}).(*tsl.EntityRequest)
+	return req, ok
+}
+
+// EnvelopeRequestDecoder decodes the params of the tsl.EntityRequest to
+// object.
+func EnvelopeRequestDecoder(ctx context.Context, data []byte, v interface{}) error {
+	req, ok := EntityRequestFromContext(ctx)
+	if !ok {
+		if len(data) == 0 {
+			return nil
+		}
+		req = &tsl.EntityRequest{}
+		if err := json.Unmarshal(data, req); err != nil {
+			return errors.BadRequest("CODEC", err.Error())
+		}
+	}
+	if len(req.Params) == 0 {
+		return nil
+	}
+	if err := encoding.GetCodec(kjson.Name).Unmarshal(req.Params, v); err != nil {
+		return errors.BadRequest("CODEC", err.Error())
+	}
+	return nil
+}
+
+// EnvelopeResponseEncoder wraps the object in a tsl.EntityReply with code 200.
+func EnvelopeResponseEncoder(ctx context.Context, c pmqtt.Client, topic string, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	data, err := encoding.GetCodec(kjson.Name).Marshal(v)
+	if err != nil {
+		return err
+	}
+	return publishEntityReply(ctx, c, topic, http.StatusOK, data)
+}
+
+// EnvelopeErrorEncoder wraps the error in a tsl.EntityReply, the code is the
+// error code and the data holds the reason and message.
+func EnvelopeErrorEncoder(ctx context.Context, c pmqtt.Client, topic string, err error) error {
+	se := errors.FromError(err)
+	data, err := json.Marshal(struct {
+		Reason  string `json:"reason,omitempty"`
+		Message string `json:"message,omitempty"`
+	}{se.Reason, se.Message})
+	if err != nil {
+		return err
+	}
+	return publishEntityReply(ctx, c, topic, int(se.Code), data)
+}
+
+func publishEntityReply(ctx context.Context, c pmqtt.Client, topic string, code int, data []byte) error {
+	reply := tsl.EntityReply{
+		Code:      code,
+		Data:      data,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if req, ok := EntityRequestFromContext(ctx); ok {
+		reply.ID = req.ID
+		reply.Method = req.Method
+	}
+	if reply.ID == "" {
+		reply.ID, _ = RequestIDFromContext(ctx)
+	}
+	body, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	if body, err = encodeReplyHeader(ctx, body); err != nil {
+		return err
+	}
+	return PublishReply(ctx, c, topic, body)
+}
+
+// entityRequest returns the context carrying the envelope of the message.
+func entityRequest(ctx context.Context, msg pmqtt.Message) context.Context {
+	var req tsl.EntityRequest
+	if err := json.Unmarshal(msg.Payload(), &req); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, entityRequestKey{}, &req)
+}
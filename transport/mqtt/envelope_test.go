@@ -0,0 +1,57 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/bytectl/gopkg/tsl"
+	"github.com/go-kratos/kratos/v2/errors"
+)
+
+func TestEnvelopeMode(t *testing.T) {
+	srv := NewServer(EnvelopeMode())
+	c := &testClient{connected: true}
+	r := srv.Route()
+	var in testData
+	r.Handle("/sys/:pk/:dn/thing/event/property/post", func(ctx Context) {
+		if err := ctx.Bind(&in); err != nil {
+			t.Error(err)
+		}
+		_ = ctx.Reply(&testData{Path: "ok"})
+	})
+	r.Handle("/sys/:pk/:dn/thing/service/:id", func(ctx Context) {
+		_ = ctx.ReplyErr(errors.New(460, "INVALID", "invalid params"))
+	})
+	srv.router.ServeMQTT(c, &testMessage{
+		topic:   "/sys/pk/dn/thing/event/property/post",
+		payload: []byte(`{"id":"1","version":"1.0","method":"thing.event.property.post","params":{"path":"a"}}`),
+	})
+	srv.router.ServeMQTT(c, &testMessage{
+		topic:   "/sys/pk/dn/thing/service/reboot",
+		payload: []byte(`{"id":"2","version":"1.0","method":"thing.service.reboot","params":{}}`),
+	})
+	if in.Path != "a" {
+		t.Errorf("expected params bound, got %+v", in)
+	}
+	if len(c.pubs) != 2 {
+		t.Fatalf("expected 2 replies, got %v", c.pubs)
+	}
+
+	var reply tsl.EntityReply
+	if err := json.Unmarshal(c.pubs[0].payload, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.ID != "1" || reply.Code != 200 || reply.Method != "thing.event.property.post" ||
+		string(reply.Data) != `{"path":"ok"}` || reply.Timestamp == 0 {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+
+	reply = tsl.EntityReply{}
+	if err := json.Unmarshal(c.pubs[1].payload, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.ID != "2" || reply.Code != 460 || reply.Method != "thing.service.reboot" ||
+		string(reply.Data) != `{"reason":"INVALID","message":"invalid params"}` {
+		t.Errorf("unexpected error reply %+v %s", reply, reply.Data)
+	}
+}
@@ -0,0 +1,248 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// FailoverPolicy is the order the brokers are tried in on connect and
+// reconnect.
+type FailoverPolicy int
+
+const (
+	// FailoverOrdered tries the brokers in the order they were added.
+	FailoverOrdered FailoverPolicy = iota
+	// FailoverRandom tries the brokers in a random order.
+	FailoverRandom
+	// FailoverRoundRobin starts every connect from the broker after the
+	// one the previous connect started from.
+	FailoverRoundRobin
+)
+
+// errConnectFailed is the error of a broker the client moved on from.
+var errConnectFailed = errors.New("connect failed")
+
+// Failover with the broker failover policy. A broker failing is tried after
+// the healthy ones until the cooldown elapsed, 0 keeps the policy order.
+// The paho.mqtt.golang client tracks every broker it tries, the
+// ProtocolVersionV5 client only orders the brokers.
+//
+// The order is refreshed when the client reconnects. With ConnectRetry the
+// client retries the first connect in the order set by NewServer, so the
+// policy and the cooldown apply from the first reconnect only.
+func Failover(policy FailoverPolicy, cooldown time.Duration) ServerOption {
+	return func(o *Server) {
+		o.failover.policy = policy
+		o.failover.cooldown = cooldown
+	}
+}
+
+// BrokerStatus is the health of a broker.
+type BrokerStatus struct {
+	URL         string
+	Connected   bool
+	Failures    int
+	LastError   error
+	LastFailure time.Time
+	LastConnect time.Time
+}
+
+type brokerState struct {
+	url         *url.URL
+	connected   bool
+	failures    int
+	lastErr     error
+	lastFailure time.Time
+	lastConnect time.Time
+}
+
+// failover orders the brokers by policy and health, and tracks the broker
+// the client connects to.
+type failover struct {
+	policy   FailoverPolicy
+	cooldown time.Duration
+
+	mu      sync.Mutex
+	brokers []*brokerState
+	current *brokerState
+	next    int
+	now     func() time.Time
+	shuffle func(n int, swap func(i, j int))
+}
+
+func (f *failover) init(servers []*url.URL) {
+	f.brokers = make([]*brokerState, 0, len(servers))
+	for _, u := range servers {
+		f.brokers = append(f.brokers, &brokerState{url: u})
+	}
+	if f.now == nil {
+		f.now = time.Now
+	}
+	if f.shuffle == nil {
+		f.shuffle = rand.Shuffle
+	}
+}
+
+// order returns the brokers to try: by policy, the ones failing within the
+// cooldown last, longest failing first.
+func (f *failover) order() []*url.URL {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	brokers := make([]*brokerState, len(f.brokers))
+	copy(brokers, f.brokers)
+	switch f.policy {
+	case FailoverRandom:
+		f.shuffle(len(brokers), func(i, j int) { brokers[i], brokers[j] = brokers[j], brokers[i] })
+	case FailoverRoundRobin:
+		if n := len(brokers); n > 0 {
+			start := f.next % n
+			brokers = append(brokers[start:], brokers[:start]...)
+			f.next = start + 1
+		}
+	}
+	now := f.now()
+	failing := func(b *brokerState) bool {
+		return !b.lastFailure.IsZero() && now.Sub(b.lastFailure) < f.cooldown
+	}
+	sort.SliceStable(brokers, func(i, j int) bool {
+		fi, fj := failing(brokers[i]), failing(brokers[j])
+		if fi != fj {
+			return fj
+		}
+		return fi && brokers[i].lastFailure.Before(brokers[j].lastFailure)
+	})
+	servers := make([]*url.URL, 0, len(brokers))
+	for _, b := range brokers {
+		servers = append(servers, b.url)
+	}
+	return servers
+}
+
+// attempt tracks the broker the client tries, the broker tried before it
+// failed.
+func (f *failover) attempt(broker *url.URL) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b := f.lookup(broker)
+	if f.current != nil && f.current != b && !f.current.connected {
+		f.fail(f.current, errConnectFailed)
+	}
+	f.current = b
+}
+
+// connected marks the broker tried last connected.
+func (f *failover) connected() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.current != nil {
+		f.current.connected = true
+		f.current.lastConnect = f.now()
+	}
+}
+
+// failed marks the broker tried last failed.
+func (f *failover) failed(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.current != nil {
+		f.fail(f.current, err)
+	}
+}
+
+func (f *failover) fail(b *brokerState, err error) {
+	b.connected = false
+	b.failures++
+	b.lastErr = err
+	b.lastFailure = f.now()
+}
+
+func (f *failover) lookup(broker *url.URL) *brokerState {
+	for _, b := range f.brokers {
+		if b.url == broker || b.url.String() == broker.String() {
+			return b
+		}
+	}
+	b := &brokerState{url: broker}
+	f.brokers = append(f.brokers, b)
+	return b
+}
+
+// endpoint returns the connected broker.
+func (f *failover) endpoint() (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.current == nil || !f.current.connected {
+		return "", false
+	}
+	return f.current.url.Redacted(), true
+}
+
+// status returns the health of the brokers in the order they were added.
+func (f *failover) status() []BrokerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := make([]BrokerStatus, 0, len(f.brokers))
+	for _, b := range f.brokers {
+		status = append(status, BrokerStatus{
+			URL:         b.url.Redacted(),
+			Connected:   b.connected,
+			Failures:    b.failures,
+			LastError:   b.lastErr,
+			LastFailure: b.lastFailure,
+			LastConnect: b.lastConnect,
+		})
+	}
+	return status
+}
+
+// connectError reports every broker with its last error.
+func (f *failover) connectError(err error) error {
+	status := f.status()
+	brokers := make([]string, 0, len(status))
+	for _, b := range status {
+		if b.LastError != nil {
+			brokers = append(brokers, fmt.Sprintf("%s (%v)", b.URL, b.LastError))
+		} else {
+			brokers = append(brokers, b.URL)
+		}
+	}
+	return fmt.Errorf("mqtt connect [%s]: %w", strings.Join(brokers, ", "), err)
+}
+
+// hook sets the client options to order the brokers and track the connect
+// attempts, chaining the handlers already set. The paho.mqtt.golang client
+// only reads the servers again from OnReconnecting, its ConnectRetry loop
+// keeps the initial order.
+func (f *failover) hook(o *pmqtt.ClientOptions) {
+	f.init(o.Servers)
+	o.Servers = f.order()
+	attempt := o.OnConnectAttempt
+	o.SetConnectionAttemptHandler(func(broker *url.URL, cfg *tls.Config) *tls.Config {
+		f.attempt(broker)
+		if attempt != nil {
+			return attempt(broker, cfg)
+		}
+		return cfg
+	})
+	reconnecting := o.OnReconnecting
+	o.SetReconnectingHandler(func(c pmqtt.Client, opts *pmqtt.ClientOptions) {
+		opts.Servers = f.order()
+		if reconnecting != nil {
+			reconnecting(c, opts)
+		}
+	})
+}
+
+// Brokers returns the health of the brokers.
+func (o *Server) Brokers() []BrokerStatus {
+	return o.failover.status()
+}
@@ -0,0 +1,166 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testBrokers(t *testing.T, brokers ...string) []*url.URL {
+	urls := make([]*url.URL, 0, len(brokers))
+	for _, b := range brokers {
+		u, err := url.Parse(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+func hosts(urls []*url.URL) []string {
+	hs := make([]string, 0, len(urls))
+	for _, u := range urls {
+		hs = append(hs, u.Host)
+	}
+	return hs
+}
+
+func TestFailoverOrder(t *testing.T) {
+	servers := testBrokers(t, "tcp://a:1883", "tcp://b:1883", "tcp://c:1883")
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	f := &failover{policy: FailoverRoundRobin, cooldown: time.Minute, now: clock}
+	f.init(servers)
+	for _, want := range [][]string{
+		{"a:1883", "b:1883", "c:1883"},
+		{"b:1883", "c:1883", "a:1883"},
+		{"c:1883", "a:1883", "b:1883"},
+		{"a:1883", "b:1883", "c:1883"},
+	} {
+		if got := hosts(f.order()); !reflect.DeepEqual(got, want) {
+			t.Errorf("round robin: expected %v, got %v", want, got)
+		}
+	}
+
+	f = &failover{policy: FailoverOrdered, cooldown: time.Minute, now: clock}
+	f.init(servers)
+	f.attempt(servers[0])
+	now = now.Add(time.Second)
+	f.attempt(servers[1])
+	f.failed(errors.New("refused"))
+	if got, want := hosts(f.order()), []string{"c:1883", "a:1883", "b:1883"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the failing brokers last, got %v", got)
+	}
+	now = now.Add(time.Minute)
+	if got, want := hosts(f.order()), []string{"a:1883", "b:1883", "c:1883"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the cooldown elapsed, got %v", got)
+	}
+
+	f = &failover{policy: FailoverRandom, now: clock, shuffle: func(n int, swap func(i, j int)) { swap(0, n-1) }}
+	f.init(servers)
+	if got, want := hosts(f.order()), []string{"c:1883", "b:1883", "a:1883"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("random: expected %v, got %v", want, got)
+	}
+}
+
+func TestFailoverTracking(t *testing.T) {
+	srv := NewServer(Broker("tcp://a:1883"), Broker("tcp://b:1883"), Failover(FailoverOrdered, time.Minute))
+	c := &testClient{connected: true}
+	srv.mqttClient = c
+	servers := srv.clientOption.Servers
+	srv.clientOption.OnConnectAttempt(servers[0], nil)
+	srv.clientOption.OnConnectAttempt(servers[1], nil)
+	srv.onConnect(c)
+
+	brokers := srv.Brokers()
+	if brokers[0].Connected || brokers[0].Failures != 1 || brokers[0].LastError == nil {
+		t.Errorf("expected broker a failed, got %+v", brokers[0])
+	}
+	if !brokers[1].Connected || brokers[1].LastConnect.IsZero() {
+		t.Errorf("expected broker b connected, got %+v", brokers[1])
+	}
+	if st := srv.Health(); st.Endpoint != "tcp://b:1883" {
+		t.Errorf("expected the connected broker, got %s", st.Endpoint)
+	}
+
+	srv.clientOption.OnConnectionLost(c, errors.New("lost"))
+	if b := srv.Brokers()[1]; b.Connected || b.LastError.Error() != "lost" {
+		t.Errorf("expected broker b lost, got %+v", b)
+	}
+	// the reconnect tries the brokers failing last first
+	srv.clientOption.OnReconnecting(c, srv.clientOption)
+	if got := hosts(srv.clientOption.Servers); !reflect.DeepEqual(got, []string{"a:1883", "b:1883"}) {
+		t.Errorf("unexpected reconnect order %v", got)
+	}
+}
+
+func TestServerStartFailover(t *testing.T) {
+	srv := NewServer(
+		Broker("tcp://127.0.0.1:1"),
+		Broker("tcp://127.0.0.1:2"),
+		ConnectTimeout(time.Second),
+		Failover(FailoverOrdered, time.Minute),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := srv.Start(ctx)
+	if err == nil {
+		t.Fatal("expected connect error")
+	}
+	for _, broker := range []string{"tcp://127.0.0.1:1", "tcp://127.0.0.1:2"} {
+		if !strings.Contains(err.Error(), broker+" (") {
+			t.Errorf("expected %s reported, got %v", broker, err)
+		}
+	}
+	for _, b := range srv.Brokers() {
+		if b.Failures != 1 {
+			t.Errorf("expected %s failed once, got %+v", b.URL, b)
+		}
+	}
+}
+
+func TestServerTLSOptions(t *testing.T) {
+	cert := tls.Certificate{Certificate: [][]byte{{1}}}
+	srv := NewServer(
+		Broker("ssl://127.0.0.1:8883"),
+		ClientCertificate(cert),
+		KeepAlive(10*time.Second),
+		MaxReconnectInterval(time.Minute),
+		Will("/sys/p1/d1/offline", []byte("bye"), 1, true),
+	)
+	o := srv.clientOption
+	if o.TLSConfig == nil || len(o.TLSConfig.Certificates) != 1 {
+		t.Fatalf("expected the client certificate, got %+v", o.TLSConfig)
+	}
+	if o.KeepAlive != 10 || o.MaxReconnectInterval != time.Minute {
+		t.Errorf("unexpected keepalive %v, max reconnect interval %v", o.KeepAlive, o.MaxReconnectInterval)
+	}
+	if !o.WillEnabled || o.WillTopic != "/sys/p1/d1/offline" || string(o.WillPayload) != "bye" || o.WillQos != 1 || !o.WillRetained {
+		t.Errorf("unexpected will %+v", o)
+	}
+	if o.Dialer == nil || o.Dialer.Timeout != o.ConnectTimeout {
+		t.Errorf("expected the dial bounded by the connect timeout, got %+v", o.Dialer)
+	}
+	pool := x509.NewCertPool()
+	cfg := &tls.Config{ServerName: "broker"}
+	o = NewServer(RootCAs(pool), ClientCertificate(cert), TLSConfig(cfg)).clientOption
+	if o.TLSConfig == cfg || o.TLSConfig.ServerName != "broker" || o.TLSConfig.RootCAs != pool || len(o.TLSConfig.Certificates) != 1 {
+		t.Errorf("expected the options merged on a copy of the tls config, got %+v", o.TLSConfig)
+	}
+	if cfg.RootCAs != nil || len(cfg.Certificates) != 0 {
+		t.Errorf("expected the caller's tls config untouched, got %+v", cfg)
+	}
+	d := &net.Dialer{Timeout: time.Second}
+	if srv := NewServer(Dialer(d)); srv.clientOption.Dialer != d {
+		t.Errorf("expected the custom dialer, got %+v", srv.clientOption.Dialer)
+	}
+}
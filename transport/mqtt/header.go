@@ -0,0 +1,132 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/transport"
+)
+
+// DecodeHeaderFunc is decode request header func.
+// MQTT 3.1.1 has no message headers, so they have to travel in the payload.
+type DecodeHeaderFunc func(msg pmqtt.Message, header transport.Header)
+
+// EncodeHeaderFunc is encode request or reply header func, it returns the
+// payload carrying the header.
+type EncodeHeaderFunc func(header transport.Header, body []byte) ([]byte, error)
+
+// EnvelopeHeaderDecoder reads the header from the field of a JSON payload, eg:
+//
+//	{"header":{"Authorization":"Bearer xxx"},"params":{...}}
+func EnvelopeHeaderDecoder(field string) DecodeHeaderFunc {
+	return func(msg pmqtt.Message, header transport.Header) {
+		var envelope map[string]json.RawMessage
+		if err := json.Unmarshal(msg.Payload(), &envelope); err != nil {
+			return
+		}
+		raw, ok := envelope[field]
+		if !ok {
+			return
+		}
+		var values map[string]string
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return
+		}
+		for k, v := range values {
+			header.Set(k, v)
+		}
+	}
+}
+
+// HeaderEncoder with server reply and publish header encoder, eg
+// EnvelopeHeaderEncoder, so the header travels in the MQTT 3.1.1 payload.
+func HeaderEncoder(enc EncodeHeaderFunc) ServerOption {
+	return func(o *Server) {
+		o.encHeader = enc
+	}
+}
+
+// EnvelopeHeaderEncoder writes the header into the field of a JSON payload.
+func EnvelopeHeaderEncoder(field string) EncodeHeaderFunc {
+	return func(header transport.Header, body []byte) ([]byte, error) {
+		keys := header.Keys()
+		if len(keys) == 0 {
+			return body, nil
+		}
+		values := make(map[string]string, len(keys))
+		for _, k := range keys {
+			values[k] = header.Get(k)
+		}
+		raw, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		if len(body) == 0 {
+			body = []byte("{}")
+		}
+		return setJSONField(body, field, raw)
+	}
+}
+
+// encodeReplyHeader encodes the reply header of the handler in ctx into the
+// reply body with the header encoder of the server.
+func encodeReplyHeader(ctx context.Context, body []byte) ([]byte, error) {
+	route, ok := ctx.Value(routeKey{}).(*routeOptions)
+	if !ok || route.encHeader == nil {
+		return body, nil
+	}
+	tr, ok := transport.FromServerContext(ctx)
+	if !ok {
+		return body, nil
+	}
+	return route.encHeader(tr.ReplyHeader(), body)
+}
+
+var errNotObject = errors.New("payload is not a JSON object")
+
+// setJSONField sets the field of the JSON object to the raw value, keeping
+// the order of the other fields.
+func setJSONField(body []byte, field string, value json.RawMessage) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errNotObject
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	write := func(key string, v json.RawMessage) {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	set := false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		if key == field {
+			v, set = value, true
+		}
+		write(key, v)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if !set {
+		write(field, value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,91 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/transport"
+)
+
+type testMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return 0 }
+func (m *testMessage) Retained() bool    { return false }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 0 }
+func (m *testMessage) Payload() []byte   { return m.payload }
+func (m *testMessage) Ack()              {}
+
+func TestEnvelopeHeader(t *testing.T) {
+	header := headerCarrier{}
+	header.Set("Authorization", "Bearer token")
+	body, err := EnvelopeHeaderEncoder("header")(header, []byte(`{"a":"1"}`))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	got := headerCarrier{}
+	EnvelopeHeaderDecoder("header")(&testMessage{payload: body}, got)
+	if v := got.Get("authorization"); v != "Bearer token" {
+		t.Errorf("expected %q, got %q", "Bearer token", v)
+	}
+	v := &struct {
+		A string `json:"a"`
+	}{}
+	if err = DefaultRequestContextDecoder(context.Background(), body, v); err != nil || v.A != "1" {
+		t.Errorf("expected a=1, got %+v, err %v", v, err)
+	}
+}
+
+func TestServerHeaderEncoder(t *testing.T) {
+	srv := NewServer(HeaderEncoder(EnvelopeHeaderEncoder("header")), Middleware(func(h middleware.Handler) middleware.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			if tr, ok := transport.FromServerContext(ctx); ok {
+				tr.ReplyHeader().Set("X-Trace", "t1")
+			}
+			return h(ctx, req)
+		}
+	}))
+	c := &testClient{connected: true}
+	srv.Route().Handle("/sys/:pk/:dn/thing/service/property/set", func(ctx Context) {
+		h := ctx.Middleware(func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		if _, err := h(ctx, nil); err != nil {
+			t.Error(err)
+		}
+		if err := ctx.Reply(map[string]int{"code": 200}); err != nil {
+			t.Error(err)
+		}
+	})
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/p1/d1/thing/service/property/set"})
+	if len(c.pubs) != 1 {
+		t.Fatalf("expected a reply, got %v", c.pubs)
+	}
+	if got, want := string(c.pubs[0].payload), `{"code":200,"header":{"X-Trace":"t1"}}`; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestSetJSONField(t *testing.T) {
+	tests := []struct {
+		body, want string
+	}{
+		{`{"b":1,"a":{"x":[1,2]}}`, `{"b":1,"a":{"x":[1,2]},"id":"7"}`},
+		{`{"id":"1","b":true}`, `{"id":"7","b":true}`},
+		{`{}`, `{"id":"7"}`},
+	}
+	for _, tt := range tests {
+		got, err := setJSONField([]byte(tt.body), "id", []byte(`"7"`))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: expected %s, got %s %v", tt.body, tt.want, got, err)
+		}
+	}
+	if _, err := setJSONField([]byte(`[1]`), "id", []byte(`"7"`)); err == nil {
+		t.Error("expected not an object error")
+	}
+}
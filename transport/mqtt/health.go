@@ -0,0 +1,62 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bytectl/gopkg/transport/health"
+)
+
+var _ health.Checker = (*Server)(nil)
+
+// connState is the broker connection state of the server.
+type connState struct {
+	mu          sync.Mutex
+	lastErr     error
+	lastConnect time.Time
+}
+
+func (s *connState) connected() {
+	s.mu.Lock()
+	s.lastConnect = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *connState) failed(err error) {
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+}
+
+// Health returns the health of the server: the broker connection state, the
+// last connect time and error, and the status of the subscriptions. It is
+// ready when connected with every subscription acknowledged.
+func (s *Server) Health() health.Status {
+	st := health.Status{
+		Name:      string(KindMQTT),
+		Endpoint:  s.endpoint,
+		Connected: s.Ready(),
+	}
+	s.state.mu.Lock()
+	if s.state.lastErr != nil {
+		st.LastError = s.state.lastErr.Error()
+	}
+	if !s.state.lastConnect.IsZero() {
+		t := s.state.lastConnect
+		st.LastConnect = &t
+	}
+	s.state.mu.Unlock()
+	if endpoint, ok := s.failover.endpoint(); ok {
+		st.Endpoint = endpoint
+	}
+	st.Ready = st.Connected
+	for _, sub := range s.Subscriptions() {
+		hs := health.Subscription{Topic: sub.Topic, Qos: sub.Qos, Subscribed: sub.Subscribed}
+		if sub.Err != nil {
+			hs.Error = sub.Err.Error()
+		}
+		st.Ready = st.Ready && sub.Subscribed
+		st.Subscriptions = append(st.Subscriptions, hs)
+	}
+	return st
+}
@@ -0,0 +1,23 @@
+// Package testgreeter is a Greeter service generated by protoc-gen-go-mqtt,
+// its messages written by hand, to test the generated handlers.
+package testgreeter
+
+import "errors"
+
+// HelloRequest is the request of SayHello.
+type HelloRequest struct {
+	Name string `json:"name"`
+}
+
+// Validate requires the name.
+func (m *HelloRequest) Validate() error {
+	if m.Name == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+// HelloReply is the reply of SayHello.
+type HelloReply struct {
+	Message string `json:"message"`
+}
@@ -0,0 +1,71 @@
+package testgreeter
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/middleware"
+
+	"github.com/bytectl/gopkg/transport/mqtt"
+	"github.com/bytectl/gopkg/transport/mqtt/mqtttest"
+)
+
+type greeter struct{}
+
+func (greeter) SayHello(_ mqtt.Context, in *HelloRequest) (*HelloReply, error) {
+	return &HelloReply{Message: "hello " + in.Name}, nil
+}
+
+func replyTopic(topic string) string { return topic + "_reply" }
+
+// request serves the Greeter with the middleware and requests SayHello.
+func request(t *testing.T, payload string, ms ...middleware.Middleware) string {
+	b := mqtttest.NewBroker()
+	m := &mqtt.MQTTSubscribe{}
+	srv := mqtt.NewServer(b.ServerOption(), mqtt.Middleware(ms...), mqtt.ReplyTopicStrategy(replyTopic),
+		mqtt.OnConnectHandler(func(c pmqtt.Client) {
+			SubscribeGreeter(c, m)
+		}))
+	m.SetServer(srv)
+	RegisterGreeterMQTTServer(srv, greeter{})
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop(context.Background())
+	reply, err := b.Request(context.Background(), "/helloworld.Greeter/SayHello", []byte(payload),
+		mqtttest.ReplyTopicStrategy(replyTopic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(reply)
+}
+
+func TestGreeterReply(t *testing.T) {
+	if reply := request(t, `{"name":"kratos"}`); reply != `{"message":"hello kratos"}` {
+		t.Errorf("unexpected reply %s", reply)
+	}
+}
+
+func TestGreeterMiddlewareError(t *testing.T) {
+	auth := func(middleware.Handler) middleware.Handler {
+		return func(context.Context, interface{}) (interface{}, error) {
+			return nil, errors.Unauthorized("UNAUTHORIZED", "token required")
+		}
+	}
+	reply := request(t, `{"name":"kratos"}`, auth)
+	if !strings.Contains(reply, `"code":401`) || !strings.Contains(reply, `"reason":"UNAUTHORIZED"`) {
+		t.Errorf("expected the middleware error replied, got %s", reply)
+	}
+}
+
+func TestGreeterValidateError(t *testing.T) {
+	if reply := request(t, `{}`); !strings.Contains(reply, `"reason":"VALIDATOR"`) {
+		t.Errorf("expected the validate error replied, got %s", reply)
+	}
+	if reply := request(t, `{`); !strings.Contains(reply, `"reason":"CODEC"`) {
+		t.Errorf("expected the decode error replied, got %s", reply)
+	}
+}
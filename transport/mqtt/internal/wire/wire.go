@@ -0,0 +1,23 @@
+// Package wire holds the payload conversions shared by the MQTT clients.
+package wire
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// PayloadBytes returns the bytes of a publish payload, a []byte, string or
+// bytes.Buffer like paho.mqtt.golang accepts.
+func PayloadBytes(payload interface{}) ([]byte, error) {
+	switch p := payload.(type) {
+	case []byte:
+		return p, nil
+	case string:
+		return []byte(p), nil
+	case bytes.Buffer:
+		return p.Bytes(), nil
+	case *bytes.Buffer:
+		return p.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown payload type %T", payload)
+}
@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bytectl/gopkg/transport/internal/metric"
+	"github.com/go-kratos/kratos/v2/metrics"
+)
+
+// The statuses of the message counter.
+const (
+	StatusReceived = metric.StatusReceived
+	StatusReplied  = "replied"
+	StatusFailed   = metric.StatusFailed
+)
+
+// MessageCounter with the counter of the routed messages, labeled with the
+// route pattern and the status: received, then replied or failed.
+func MessageCounter(c metrics.Counter) ServerOption {
+	return func(o *Server) {
+		o.metrics.Messages = c
+	}
+}
+
+// HandleSeconds with the observer of the handler latency in seconds, labeled
+// with the route pattern.
+func HandleSeconds(m metrics.Observer) ServerOption {
+	return func(o *Server) {
+		o.metrics.Seconds = m
+	}
+}
+
+// ConnectionGauge with the gauge of the broker connection state, 1 when
+// connected, else 0.
+func ConnectionGauge(g metrics.Gauge) ServerOption {
+	return func(o *Server) {
+		o.metrics.Connected = g
+	}
+}
+
+// ReconnectCounter with the counter of the broker reconnects.
+func ReconnectCounter(c metrics.Counter) ServerOption {
+	return func(o *Server) {
+		o.metrics.Reconnects = c
+	}
+}
+
+// messageStatus is the outcome of a routed message.
+type messageStatus struct {
+	mu     sync.Mutex
+	status string
+}
+
+type statusKey struct{}
+
+// setStatus records the outcome of the message handled in ctx, a failure is
+// kept and recorded on the message span.
+func setStatus(ctx context.Context, status string, err error) {
+	if st, ok := ctx.Value(statusKey{}).(*messageStatus); ok {
+		st.mu.Lock()
+		if st.status != StatusFailed {
+			st.status = status
+		}
+		st.mu.Unlock()
+	}
+	spanError(ctx, err)
+}
+
+func (st *messageStatus) get() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.status
+}
@@ -0,0 +1,294 @@
+// Package mqtttest provides an in-memory MQTT broker to test the mqtt
+// servers, routers and clients without a real broker.
+package mqtttest
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/bytectl/gopkg/transport/mqtt"
+	"github.com/bytectl/gopkg/transport/mqtt/internal/wire"
+)
+
+// ErrConnectionLost is the error of the connections dropped by
+// DropConnections.
+var ErrConnectionLost = errors.New("mqtttest: connection lost")
+
+// Broker is an in-memory MQTT broker. It supports the + and # filters, the
+// $share and $queue shared subscriptions, QoS 0 and 1 (QoS 2 is downgraded
+// to 1) and retained messages. Messages are delivered synchronously in the
+// goroutine of the publisher, once per client whatever its overlapping
+// subscriptions, the client routing them to every matching handler.
+type Broker struct {
+	mu        sync.Mutex
+	clients   []*Client
+	retained  map[string]*Message
+	published []*Message
+	shared    map[string]int
+	connErr   error
+	seq       uint16
+}
+
+// NewBroker returns a broker.
+func NewBroker() *Broker {
+	return &Broker{
+		retained: make(map[string]*Message),
+		shared:   make(map[string]int),
+	}
+}
+
+// NewClient returns a client of the broker, it is a mqtt.ClientFactory.
+func (b *Broker) NewClient(o *pmqtt.ClientOptions) pmqtt.Client {
+	c := &Client{broker: b, opts: o, subs: make(map[string]byte), routes: make(map[string]pmqtt.MessageHandler)}
+	// ClientOptionsReader can only be built by paho.mqtt.golang itself
+	c.reader = pmqtt.NewClient(o).OptionsReader()
+	b.mu.Lock()
+	b.clients = append(b.clients, c)
+	b.mu.Unlock()
+	return c
+}
+
+// remove disconnects the client and forgets it.
+func (b *Broker) remove(c *Client) {
+	c.Disconnect(0)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, cc := range b.clients {
+		if cc == c {
+			b.clients = append(b.clients[:i], b.clients[i+1:]...)
+			break
+		}
+	}
+}
+
+// ServerOption returns the option creating the server client on the broker.
+func (b *Broker) ServerOption() mqtt.ServerOption {
+	return mqtt.MQTTClientFactory(b.NewClient)
+}
+
+// ClientOption returns the option creating the client on the broker.
+func (b *Broker) ClientOption() mqtt.ClientOption {
+	return mqtt.WithClientFactory(b.NewClient)
+}
+
+// Publish publishes the payload to the topic like a device would.
+func (b *Broker) Publish(topic string, qos byte, retained bool, payload interface{}) error {
+	body, err := wire.PayloadBytes(payload)
+	if err != nil {
+		return err
+	}
+	b.publish(topic, qos, retained, body)
+	return nil
+}
+
+// Messages returns the messages published to the broker so far.
+func (b *Broker) Messages() []pmqtt.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msgs := make([]pmqtt.Message, 0, len(b.published))
+	for _, m := range b.published {
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// Subscriptions returns the filters subscribed by the connected clients.
+func (b *Broker) Subscriptions() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	seen := make(map[string]bool)
+	var filters []string
+	for _, c := range b.clients {
+		if !c.connected {
+			continue
+		}
+		for filter := range c.subs {
+			if !seen[filter] {
+				seen[filter] = true
+				filters = append(filters, filter)
+			}
+		}
+	}
+	sort.Strings(filters)
+	return filters
+}
+
+// RefuseConnections makes the connects fail with err, a nil err accepts them
+// again and reconnects the clients waiting to auto reconnect.
+func (b *Broker) RefuseConnections(err error) {
+	b.mu.Lock()
+	b.connErr = err
+	var reconnect []*Client
+	if err == nil {
+		for _, c := range b.clients {
+			if c.reconnecting {
+				reconnect = append(reconnect, c)
+			}
+		}
+	}
+	b.mu.Unlock()
+	for _, c := range reconnect {
+		c.reconnect()
+	}
+}
+
+// DropConnections simulates a broker restart: every connected client loses
+// its connection, the clients with AutoReconnect reconnect at once unless
+// the connections are refused.
+func (b *Broker) DropConnections() {
+	b.mu.Lock()
+	var dropped []*Client
+	for _, c := range b.clients {
+		if c.connected {
+			c.drop()
+			dropped = append(dropped, c)
+		}
+	}
+	b.mu.Unlock()
+	for _, c := range dropped {
+		if c.opts.OnConnectionLost != nil {
+			c.opts.OnConnectionLost(c, ErrConnectionLost)
+		}
+		if c.opts.AutoReconnect {
+			c.reconnect()
+		}
+	}
+}
+
+func (b *Broker) publish(topic string, qos byte, retained bool, payload []byte) {
+	if qos > 1 {
+		qos = 1
+	}
+	b.mu.Lock()
+	b.seq++
+	msg := &Message{topic: topic, payload: payload, qos: qos, id: b.seq}
+	b.published = append(b.published, msg)
+	if retained {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = &Message{topic: topic, payload: payload, qos: qos, retained: true}
+		}
+	}
+	type delivery struct {
+		c   *Client
+		qos byte
+	}
+	var deliveries []delivery
+	groups := make(map[string][]*Client)
+	var keys []string
+	for _, c := range b.clients {
+		if !c.connected {
+			continue
+		}
+		subQos, ok := byte(0), false
+		for filter, q := range c.subs {
+			if group, f := shareGroup(filter); group != "" {
+				if matchTopic(f, topic) {
+					key := group + "/" + f
+					if _, ok := groups[key]; !ok {
+						keys = append(keys, key)
+					}
+					groups[key] = append(groups[key], c)
+				}
+				continue
+			}
+			if matchTopic(filter, topic) {
+				if !ok || q > subQos {
+					subQos = q
+				}
+				ok = true
+			}
+		}
+		if ok {
+			deliveries = append(deliveries, delivery{c: c, qos: subQos})
+		}
+	}
+	// a shared subscription delivers to one member of the group in turn
+	sort.Strings(keys)
+	for _, key := range keys {
+		members := groups[key]
+		c := members[b.shared[key]%len(members)]
+		b.shared[key]++
+		found := false
+		for _, d := range deliveries {
+			found = found || d.c == c
+		}
+		if !found {
+			deliveries = append(deliveries, delivery{c: c, qos: qos})
+		}
+	}
+	b.mu.Unlock()
+	for _, d := range deliveries {
+		m := *msg
+		if d.qos < m.qos {
+			m.qos = d.qos
+		}
+		d.c.deliver(&m)
+	}
+}
+
+// retainedFor returns the retained messages matching the filter.
+func (b *Broker) retainedFor(filter string, qos byte) []*Message {
+	if group, _ := shareGroup(filter); group != "" {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var topics []string
+	for topic := range b.retained {
+		if matchTopic(filter, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	msgs := make([]*Message, 0, len(topics))
+	for _, topic := range topics {
+		m := *b.retained[topic]
+		if qos < m.qos {
+			m.qos = qos
+		}
+		msgs = append(msgs, &m)
+	}
+	return msgs
+}
+
+// shareGroup returns the group and the filter of a shared subscription.
+func shareGroup(filter string) (string, string) {
+	if strings.HasPrefix(filter, "$share/") {
+		if parts := strings.SplitN(filter, "/", 3); len(parts) == 3 {
+			return parts[1], parts[2]
+		}
+	}
+	if strings.HasPrefix(filter, "$queue/") {
+		return "$queue", strings.TrimPrefix(filter, "$queue/")
+	}
+	return "", filter
+}
+
+// matchTopic reports whether the topic matches the filter, a topic starting
+// with $ is not matched by a leading wildcard.
+func matchTopic(filter, topic string) bool {
+	_, filter = shareGroup(filter)
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (fs[0] == "+" || fs[0] == "#") {
+		return false
+	}
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
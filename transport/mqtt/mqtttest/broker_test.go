@@ -0,0 +1,311 @@
+package mqtttest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/bytectl/gopkg/transport/mqtt"
+	"github.com/bytectl/gopkg/transport/mqtt/mux"
+)
+
+type testRequest struct {
+	Pk   string `json:"pk"`
+	Dn   string `json:"dn"`
+	Name string `json:"name"`
+}
+
+type testReply struct {
+	Message string `json:"message"`
+}
+
+// newTestServer returns a started server replying to the hello requests
+// like a generated Register...MQTTServer handler.
+func newTestServer(t *testing.T, b *Broker, opts ...mqtt.ServerOption) *mqtt.Server {
+	m := &mqtt.MQTTSubscribe{}
+	opts = append([]mqtt.ServerOption{
+		b.ServerOption(),
+		mqtt.OnConnectHandler(func(c pmqtt.Client) {
+			m.Subscribe(c, "/sys/:pk/:dn/hello", 1)
+		}),
+	}, opts...)
+	srv := mqtt.NewServer(opts...)
+	m.SetServer(srv)
+	srv.Route().Handle("/sys/:pk/:dn/hello", func(ctx mqtt.Context) {
+		in := &testRequest{}
+		if err := ctx.Bind(in); err != nil {
+			ctx.DeadLetter(mqtt.ReasonDecode, err)
+			return
+		}
+		if err := ctx.BindVars(in); err != nil {
+			t.Error(err)
+		}
+		h := ctx.Middleware(func(_ context.Context, req interface{}) (interface{}, error) {
+			in := req.(*testRequest)
+			return &testReply{Message: "hello " + in.Name + " from " + in.Pk + "/" + in.Dn}, nil
+		})
+		out, err := h(ctx, in)
+		if err != nil {
+			_ = ctx.ReplyErr(err)
+			return
+		}
+		if err = ctx.Reply(out); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = srv.Stop(context.Background()) })
+	return srv
+}
+
+// serveOverlapping publishes one message matching two overlapping routes,
+// both subscribed, and returns the calls of each route.
+func serveOverlapping(t *testing.T, mode mux.MatchMode) map[string]int {
+	b := NewBroker()
+	routes := []string{"/sys/:pk/:dn/thing/event/post", "/sys/:pk/*rest"}
+	var mu sync.Mutex
+	got := make(map[string]int)
+	var srv *mqtt.Server
+	srv = mqtt.NewServer(b.ServerOption(), mqtt.RouterOptions(mux.Mode(mode)),
+		mqtt.OnConnectHandler(func(c pmqtt.Client) {
+			for _, route := range routes {
+				srv.Subscribe(c, route, 1)
+			}
+		}))
+	for _, route := range routes {
+		route := route
+		srv.Route().Handle(route, func(ctx mqtt.Context) {
+			mu.Lock()
+			got[route]++
+			mu.Unlock()
+		})
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop(context.Background())
+	if err := b.Publish("/sys/p1/d1/thing/event/post", 1, false, "{}"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return got
+}
+
+func TestServerOverlappingRoutes(t *testing.T) {
+	got := serveOverlapping(t, mux.MatchLevels)
+	want := map[string]int{"/sys/:pk/:dn/thing/event/post": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the message served once by the specific route, got %v", got)
+	}
+}
+
+func TestServerOverlappingFanOut(t *testing.T) {
+	got := serveOverlapping(t, mux.MatchMQTT)
+	want := map[string]int{"/sys/:pk/:dn/thing/event/post": 1, "/sys/:pk/*rest": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the message fanned out once to every route, got %v", got)
+	}
+}
+
+func TestBrokerMatch(t *testing.T) {
+	b := NewBroker()
+	c := b.NewClient(pmqtt.NewClientOptions())
+	if err := c.Connect().Error(); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, filter := range []string{"sport/+/player1", "sport/#", "#", "$SYS/+"} {
+		filter := filter
+		c.Subscribe(filter, 1, func(_ pmqtt.Client, msg pmqtt.Message) {
+			got = append(got, filter)
+		})
+	}
+	tests := []struct {
+		topic string
+		want  int
+	}{
+		{"sport/tennis/player1", 3},
+		{"sport", 2},
+		{"$SYS/uptime", 1},
+		{"news", 1},
+	}
+	for _, tt := range tests {
+		got = nil
+		if err := b.Publish(tt.topic, 0, false, "x"); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != tt.want {
+			t.Errorf("topic %q: expected %d handlers, got %v", tt.topic, tt.want, got)
+		}
+	}
+}
+
+func TestBrokerRetainedAndQos(t *testing.T) {
+	b := NewBroker()
+	if err := b.Publish("/ota/p1/version", 1, true, "v2"); err != nil {
+		t.Fatal(err)
+	}
+	c := b.NewClient(pmqtt.NewClientOptions())
+	c.Connect()
+	var msgs []pmqtt.Message
+	c.Subscribe("/ota/+/version", 0, func(_ pmqtt.Client, msg pmqtt.Message) {
+		msgs = append(msgs, msg)
+	})
+	if len(msgs) != 1 || !msgs[0].Retained() || msgs[0].Qos() != 0 || string(msgs[0].Payload()) != "v2" {
+		t.Fatalf("expected the retained message at qos 0, got %v", msgs)
+	}
+	// an empty retained payload clears it
+	b.Publish("/ota/p1/version", 1, true, "")
+	c.Unsubscribe("/ota/+/version")
+	msgs = nil
+	c.Subscribe("/ota/+/version", 1, func(_ pmqtt.Client, msg pmqtt.Message) {
+		msgs = append(msgs, msg)
+	})
+	if len(msgs) != 0 {
+		t.Errorf("expected no retained message, got %v", msgs)
+	}
+	if n := len(b.Messages()); n != 2 {
+		t.Errorf("expected 2 messages, got %d", n)
+	}
+}
+
+func TestBrokerSharedSubscription(t *testing.T) {
+	b := NewBroker()
+	got := make(map[string]int)
+	for _, id := range []string{"a", "b"} {
+		id := id
+		c := b.NewClient(pmqtt.NewClientOptions())
+		c.Connect()
+		c.Subscribe("$share/g1/sys/+/+/thing/event/post", 1, func(_ pmqtt.Client, msg pmqtt.Message) {
+			got[id]++
+		})
+	}
+	for i := 0; i < 4; i++ {
+		b.Publish("sys/p1/d1/thing/event/post", 1, false, "{}")
+	}
+	if !reflect.DeepEqual(got, map[string]int{"a": 2, "b": 2}) {
+		t.Errorf("expected the messages shared, got %v", got)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	b := NewBroker()
+	newTestServer(t, b)
+	reply, err := b.Request(context.Background(), "/sys/p1/d1/hello", []byte(`{"id":"1","name":"kratos"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"message":"hello kratos from p1/d1","id":"1"}`; string(reply) != want {
+		t.Errorf("expected %s, got %s", want, reply)
+	}
+	if len(b.clients) != 1 {
+		t.Errorf("expected the request client removed, got %d clients", len(b.clients))
+	}
+}
+
+func TestClientInvoke(t *testing.T) {
+	b := NewBroker()
+	newTestServer(t, b)
+	c, err := mqtt.NewClient(context.Background(), b.ClientOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reply := &testReply{}
+	if err = c.Invoke(context.Background(), "/sys/p1/d1/hello", &testRequest{Name: "client"}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Message != "hello client from p1/d1" {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+}
+
+func TestClientInvokeOutOfOrder(t *testing.T) {
+	b := NewBroker()
+	// a responder replying the second request first
+	responder := b.NewClient(pmqtt.NewClientOptions())
+	responder.Connect().Wait()
+	var (
+		mu       sync.Mutex
+		requests []pmqtt.Message
+	)
+	responder.Subscribe("/sys/p1/d1/hello", 0, func(c pmqtt.Client, m pmqtt.Message) {
+		mu.Lock()
+		requests = append(requests, m)
+		if len(requests) < 2 {
+			mu.Unlock()
+			return
+		}
+		pending := requests
+		requests = nil
+		mu.Unlock()
+		for i := len(pending) - 1; i >= 0; i-- {
+			var req struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			}
+			_ = json.Unmarshal(pending[i].Payload(), &req)
+			reply := fmt.Sprintf(`{"id":%q,"message":"hello %s"}`, req.ID, req.Name)
+			c.Publish(mqtt.DefaultReplyTopic(pending[i].Topic()), 0, false, reply)
+		}
+	}).Wait()
+
+	c, err := mqtt.NewClient(context.Background(), b.ClientOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			reply := &testReply{}
+			req := map[string]string{"id": name, "name": name}
+			if err := c.Invoke(context.Background(), "/sys/p1/d1/hello", req, reply); err != nil {
+				t.Error(err)
+				return
+			}
+			if want := "hello " + name; reply.Message != want {
+				t.Errorf("expected %q, got %q", want, reply.Message)
+			}
+		}(name)
+	}
+	wg.Wait()
+}
+
+func TestBrokerReconnect(t *testing.T) {
+	b := NewBroker()
+	var lost int
+	srv := newTestServer(t, b, mqtt.AutoReconnect(true), mqtt.CleanSession(true),
+		mqtt.ConnectionLostHandler(func(pmqtt.Client, error) { lost++ }))
+
+	b.RefuseConnections(errors.New("server unavailable"))
+	b.DropConnections()
+	if lost != 1 || srv.Ready() || len(b.Subscriptions()) != 0 {
+		t.Fatalf("expected the server disconnected, lost %d, subscriptions %v", lost, b.Subscriptions())
+	}
+	if _, err := b.Request(context.Background(), "/sys/p1/d1/hello", []byte(`{}`)); err == nil {
+		t.Fatal("expected the request refused")
+	}
+
+	b.RefuseConnections(nil)
+	if !srv.Ready() {
+		t.Fatal("expected the server reconnected")
+	}
+	if want := []string{"/sys/+/+/hello"}; !reflect.DeepEqual(b.Subscriptions(), want) {
+		t.Errorf("expected %v resubscribed, got %v", want, b.Subscriptions())
+	}
+	if _, err := b.Request(context.Background(), "/sys/p1/d1/hello", []byte(`{"name":"again"}`)); err != nil {
+		t.Error(err)
+	}
+}
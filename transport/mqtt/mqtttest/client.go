@@ -0,0 +1,224 @@
+package mqtttest
+
+import (
+	"sync"
+	"time"
+
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/bytectl/gopkg/transport/mqtt/internal/wire"
+)
+
+// Client is an in-memory pmqtt.Client of a Broker.
+type Client struct {
+	broker *Broker
+	opts   *pmqtt.ClientOptions
+	reader pmqtt.ClientOptionsReader
+
+	// guarded by the broker mutex
+	connected    bool
+	reconnecting bool
+	subs         map[string]byte
+
+	mu     sync.RWMutex
+	routes map[string]pmqtt.MessageHandler
+}
+
+var _ pmqtt.Client = (*Client)(nil)
+
+// IsConnected returns whether the client is connected.
+func (c *Client) IsConnected() bool {
+	return c.IsConnectionOpen()
+}
+
+// IsConnectionOpen returns whether the client is connected.
+func (c *Client) IsConnectionOpen() bool {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	return c.connected
+}
+
+// Connect connects the client, the OnConnectHandler runs before the token
+// completes.
+func (c *Client) Connect() pmqtt.Token {
+	c.broker.mu.Lock()
+	if err := c.broker.connErr; err != nil {
+		c.reconnecting = c.opts.ConnectRetry
+		c.broker.mu.Unlock()
+		return newToken(err)
+	}
+	c.connect()
+	c.broker.mu.Unlock()
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect(c)
+	}
+	return newToken(nil)
+}
+
+// Disconnect disconnects the client.
+func (c *Client) Disconnect(quiesce uint) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	c.drop()
+	c.reconnecting = false
+}
+
+// Publish publishes the payload to the broker.
+func (c *Client) Publish(topic string, qos byte, retained bool, payload interface{}) pmqtt.Token {
+	if !c.IsConnectionOpen() {
+		return newToken(pmqtt.ErrNotConnected)
+	}
+	body, err := wire.PayloadBytes(payload)
+	if err != nil {
+		return newToken(err)
+	}
+	c.broker.publish(topic, qos, retained, body)
+	return newToken(nil)
+}
+
+// Subscribe subscribes the filter, the matching retained messages are
+// delivered before the token completes.
+func (c *Client) Subscribe(topic string, qos byte, callback pmqtt.MessageHandler) pmqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// SubscribeMultiple subscribes the filters.
+func (c *Client) SubscribeMultiple(filters map[string]byte, callback pmqtt.MessageHandler) pmqtt.Token {
+	c.broker.mu.Lock()
+	if !c.connected {
+		c.broker.mu.Unlock()
+		return newToken(pmqtt.ErrNotConnected)
+	}
+	for filter, qos := range filters {
+		if qos > 1 {
+			qos = 1
+		}
+		c.subs[filter] = qos
+	}
+	c.broker.mu.Unlock()
+	for filter, qos := range filters {
+		if callback != nil {
+			c.AddRoute(filter, callback)
+		}
+		for _, m := range c.broker.retainedFor(filter, qos) {
+			c.deliver(m)
+		}
+	}
+	return newToken(nil)
+}
+
+// Unsubscribe unsubscribes the filters and removes their routes.
+func (c *Client) Unsubscribe(topics ...string) pmqtt.Token {
+	c.broker.mu.Lock()
+	for _, topic := range topics {
+		delete(c.subs, topic)
+	}
+	c.broker.mu.Unlock()
+	c.mu.Lock()
+	for _, topic := range topics {
+		delete(c.routes, topic)
+	}
+	c.mu.Unlock()
+	return newToken(nil)
+}
+
+// AddRoute routes the messages matching the filter to the callback.
+func (c *Client) AddRoute(topic string, callback pmqtt.MessageHandler) {
+	c.mu.Lock()
+	c.routes[topic] = callback
+	c.mu.Unlock()
+}
+
+// OptionsReader returns a reader of the client options.
+func (c *Client) OptionsReader() pmqtt.ClientOptionsReader {
+	return c.reader
+}
+
+// connect marks the client connected, the broker mutex is held.
+func (c *Client) connect() {
+	if c.opts.CleanSession {
+		c.subs = make(map[string]byte)
+	}
+	c.connected = true
+	c.reconnecting = false
+}
+
+// drop marks the client disconnected, the broker mutex is held.
+func (c *Client) drop() {
+	c.connected = false
+	c.reconnecting = c.opts.AutoReconnect
+	if c.opts.CleanSession {
+		c.subs = make(map[string]byte)
+	}
+}
+
+// reconnect reconnects a dropped client unless the connections are refused.
+func (c *Client) reconnect() {
+	if c.opts.OnReconnecting != nil {
+		c.opts.OnReconnecting(c, c.opts)
+	}
+	c.broker.mu.Lock()
+	if c.broker.connErr != nil || !c.reconnecting {
+		c.broker.mu.Unlock()
+		return
+	}
+	c.connect()
+	c.broker.mu.Unlock()
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect(c)
+	}
+}
+
+// deliver routes the message to every matching handler, or the default one.
+func (c *Client) deliver(m *Message) {
+	c.mu.RLock()
+	var handlers []pmqtt.MessageHandler
+	for filter, h := range c.routes {
+		if matchTopic(filter, m.topic) {
+			handlers = append(handlers, h)
+		}
+	}
+	c.mu.RUnlock()
+	if len(handlers) == 0 && c.opts.DefaultPublishHandler != nil {
+		handlers = append(handlers, c.opts.DefaultPublishHandler)
+	}
+	for _, h := range handlers {
+		h(c, m)
+	}
+}
+
+// Message is a message of the broker.
+type Message struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+	id       uint16
+}
+
+var _ pmqtt.Message = (*Message)(nil)
+
+func (m *Message) Duplicate() bool   { return false }
+func (m *Message) Qos() byte         { return m.qos }
+func (m *Message) Retained() bool    { return m.retained }
+func (m *Message) Topic() string     { return m.topic }
+func (m *Message) MessageID() uint16 { return m.id }
+func (m *Message) Payload() []byte   { return m.payload }
+func (m *Message) Ack()              {}
+
+// token is a completed pmqtt.Token.
+type token struct {
+	done chan struct{}
+	err  error
+}
+
+func newToken(err error) *token {
+	t := &token{done: make(chan struct{}), err: err}
+	close(t.done)
+	return t
+}
+
+func (t *token) Wait() bool                     { return true }
+func (t *token) WaitTimeout(time.Duration) bool { return true }
+func (t *token) Done() <-chan struct{}          { return t.done }
+func (t *token) Error() error                   { return t.err }
@@ -0,0 +1,87 @@
+package mqtttest
+
+import (
+	"context"
+	"time"
+
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/bytectl/gopkg/transport/mqtt"
+)
+
+// RequestOption is a Request option.
+type RequestOption func(*requestOptions)
+
+type requestOptions struct {
+	qos        byte
+	replyTopic mqtt.ReplyTopicFunc
+	timeout    time.Duration
+}
+
+// Qos with the qos of the request and the reply subscription.
+func Qos(qos byte) RequestOption {
+	return func(o *requestOptions) {
+		o.qos = qos
+	}
+}
+
+// ReplyTopic with the topic the reply is waited on.
+func ReplyTopic(topic string) RequestOption {
+	return func(o *requestOptions) {
+		o.replyTopic = func(string) string { return topic }
+	}
+}
+
+// ReplyTopicStrategy with the strategy deriving the reply topic from the
+// request topic, defaults to mqtt.DefaultReplyTopic.
+func ReplyTopicStrategy(f mqtt.ReplyTopicFunc) RequestOption {
+	return func(o *requestOptions) {
+		o.replyTopic = f
+	}
+}
+
+// Timeout with the time the reply is waited when the ctx has no deadline,
+// defaults to 5s.
+func Timeout(timeout time.Duration) RequestOption {
+	return func(o *requestOptions) {
+		o.timeout = timeout
+	}
+}
+
+// Request publishes the payload to the topic like a device would and returns
+// the first reply published to the reply topic.
+func (b *Broker) Request(ctx context.Context, topic string, payload []byte, opts ...RequestOption) ([]byte, error) {
+	o := requestOptions{replyTopic: mqtt.DefaultReplyTopic, timeout: 5 * time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if _, ok := ctx.Deadline(); !ok && o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	c := b.NewClient(pmqtt.NewClientOptions().SetClientID("mqtttest-request"))
+	defer b.remove(c.(*Client))
+	if err := c.Connect().Error(); err != nil {
+		return nil, err
+	}
+	ch := make(chan []byte, 1)
+	token := c.Subscribe(o.replyTopic(topic), o.qos, func(_ pmqtt.Client, msg pmqtt.Message) {
+		select {
+		case ch <- msg.Payload():
+		default:
+		}
+	})
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	if err := c.Publish(topic, o.qos, false, payload).Error(); err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,332 @@
+package mux
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MatchMode is the topic matching mode of a router.
+type MatchMode int
+
+const (
+	// MatchHTTP matches the topics like httprouter, the default: :name and
+	// *name wildcards, a topic matches a single route and conflicting
+	// patterns are rejected. The {name:re} routes are matched like
+	// MatchLevels, a topic is served by the most specific of them and the
+	// httprouter route.
+	MatchHTTP MatchMode = iota
+	// MatchMQTT matches the topics per the MQTT spec: the + and # filters,
+	// and the named :name and *name, match whole levels, empty levels are
+	// levels, topics starting with $ are not matched by a leading wildcard,
+	// and a message is delivered to every matching route, the most specific
+	// first.
+	MatchMQTT
+	// MatchLevels matches the :name and *name wildcards of MatchHTTP
+	// level by level like MatchMQTT, so patterns may overlap, eg
+	// /sys/:pk/:dn/thing/event/post and /sys/:pk/*rest. A topic is served
+	// by the matching route of the highest priority then specificity, or by
+	// every matching route with FanOut. The *name value is the remaining
+	// levels without the leading '/'.
+	MatchLevels
+)
+
+// RouterOption is a router option.
+type RouterOption func(*Router)
+
+// Mode with the topic matching mode of the router, MatchMQTT enables FanOut.
+func Mode(mode MatchMode) RouterOption {
+	return func(r *Router) {
+		r.mode = mode
+		r.fanOut = mode == MatchMQTT
+	}
+}
+
+// FanOut with whether a topic is delivered to every matching route, in
+// priority then specificity order, or to the first one only.
+func FanOut(fanOut bool) RouterOption {
+	return func(r *Router) {
+		r.fanOut = fanOut
+	}
+}
+
+type segmentKind uint8
+
+const (
+	segStatic segmentKind = iota
+	segParam              // a single level
+	segMulti              // the remaining levels
+	segSpan               // the levels matching a constraint with a '/'
+)
+
+type segment struct {
+	kind segmentKind
+	// value is the level of a static segment, the name of a wildcard.
+	value string
+	// re is the constraint of a {name:re} wildcard.
+	re *regexp.Regexp
+}
+
+func (s segment) key() string {
+	var re string
+	if s.re != nil {
+		re = "{" + s.re.String()
+	}
+	switch s.kind {
+	case segParam:
+		return "+" + s.value + re
+	case segMulti:
+		return "#" + s.value
+	case segSpan:
+		return "~" + s.value + re
+	}
+	return "/" + s.value
+}
+
+// levelRoute is a route of the level matcher.
+type levelRoute struct {
+	route  Route
+	handle HandlerFunc
+	seq    int     // registration order
+	rank   []uint8 // the specificity of the levels
+}
+
+// newLevelRoute returns the route of the pattern segments, a static level is
+// more specific than a constrained wildcard, then a single level wildcard,
+// then a multi-level one.
+func newLevelRoute(route Route, segs []segment, handle HandlerFunc) *levelRoute {
+	r := &levelRoute{route: route, handle: handle, rank: make([]uint8, len(segs))}
+	for i, seg := range segs {
+		switch {
+		case seg.kind == segStatic:
+			r.rank[i] = 3
+		case seg.re != nil:
+			r.rank[i] = 2
+		case seg.kind == segParam:
+			r.rank[i] = 1
+		}
+	}
+	return r
+}
+
+// before reports whether the route is served before the other one: the
+// higher priority, the more specific levels, the fewer levels (an exact
+// match before a multi-level parent match), then the first registered.
+func (r *levelRoute) before(o *levelRoute) bool {
+	if r.route.Priority != o.route.Priority {
+		return r.route.Priority > o.route.Priority
+	}
+	for i := 0; i < len(r.rank) && i < len(o.rank); i++ {
+		if r.rank[i] != o.rank[i] {
+			return r.rank[i] > o.rank[i]
+		}
+	}
+	if len(r.rank) != len(o.rank) {
+		return len(r.rank) < len(o.rank)
+	}
+	return r.seq < o.seq
+}
+
+// levelNode is a node of the level matcher, a trie of the pattern levels.
+type levelNode struct {
+	children map[string]*levelNode
+	wild     []*levelNode // the wildcard children
+	segment  segment
+	route    *levelRoute
+}
+
+// levelMatcher matches the topics level by level, a topic may match many
+// routes.
+type levelMatcher struct {
+	root levelNode
+	seq  int
+}
+
+// parseFilter parses an MQTT topic filter, + and :name match a level, # and
+// *name the remaining levels, {name} a level and {name:re} the level, or the
+// levels if re has a '/', matching re.
+func parseFilter(pattern string) ([]segment, error) {
+	levels := splitLevels(pattern)
+	segs := make([]segment, 0, len(levels))
+	for i, level := range levels {
+		var seg segment
+		switch {
+		case strings.HasPrefix(level, "{") && strings.HasSuffix(level, "}"):
+			var err error
+			if seg, err = parseConstraint(level[1 : len(level)-1]); err != nil {
+				return nil, fmt.Errorf("level %q: %v", level, err)
+			}
+		case level == "+":
+			seg = segment{kind: segParam}
+		case level == "#":
+			seg = segment{kind: segMulti}
+		case strings.HasPrefix(level, ":"):
+			seg = segment{kind: segParam, value: level[1:]}
+		case strings.HasPrefix(level, "*"):
+			seg = segment{kind: segMulti, value: level[1:]}
+		default:
+			if strings.ContainsAny(level, "+#{}") {
+				return nil, fmt.Errorf("wildcard in level %q must occupy the entire level", level)
+			}
+			seg = segment{kind: segStatic, value: level}
+		}
+		if seg.kind != segStatic && strings.ContainsAny(seg.value, ":*+#/") {
+			return nil, fmt.Errorf("invalid wildcard name in level %q", level)
+		}
+		if seg.kind == segMulti && i != len(levels)-1 {
+			return nil, fmt.Errorf("multi-level wildcard %q must be the last level", level)
+		}
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// parseConstraint parses the name[:re] of a {name:re} level.
+func parseConstraint(s string) (segment, error) {
+	name, expr := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		name, expr = s[:i], s[i+1:]
+	}
+	seg := segment{kind: segParam, value: strings.TrimSpace(name)}
+	if seg.value == "" {
+		return seg, fmt.Errorf("missing wildcard name")
+	}
+	if expr == "" {
+		return seg, nil
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return seg, err
+	}
+	seg.re = re
+	if strings.Contains(expr, "/") {
+		seg.kind = segSpan
+	}
+	return seg, nil
+}
+
+// splitLevels splits the pattern levels, a '/' in braces is kept.
+func splitLevels(pattern string) []string {
+	var levels []string
+	depth, start := 0, 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case '/':
+			if depth == 0 {
+				levels = append(levels, pattern[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(levels, pattern[start:])
+}
+
+// Filter returns the MQTT topic filter subscribing the topics of the route
+// pattern: the single level wildcards are +, the multi-level ones # and a
+// constraint spanning levels ends the filter with #.
+func Filter(pattern string) string {
+	levels := splitLevels(pattern)
+	for i, level := range levels {
+		switch {
+		case strings.HasPrefix(level, ":"):
+			levels[i] = "+"
+		case strings.HasPrefix(level, "*"):
+			levels[i] = "#"
+		case strings.HasPrefix(level, "{") && strings.HasSuffix(level, "}"):
+			levels[i] = "+"
+			if strings.Contains(level, "/") {
+				levels[i] = "#"
+				return strings.Join(levels[:i+1], "/")
+			}
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
+// add registers the route, a handle already registered for the pattern is
+// replaced when replace is set.
+func (m *levelMatcher) add(segs []segment, route *levelRoute, replace bool) error {
+	n := &m.root
+	for _, seg := range segs {
+		if n.children == nil {
+			n.children = make(map[string]*levelNode)
+		}
+		child, ok := n.children[seg.key()]
+		if !ok {
+			child = &levelNode{segment: seg}
+			n.children[seg.key()] = child
+			if seg.kind != segStatic {
+				n.wild = append(n.wild, child)
+			}
+		}
+		n = child
+	}
+	if n.route != nil {
+		if !replace {
+			return fmt.Errorf("a handle is already registered for pattern %q", n.route.route.Pattern)
+		}
+		route.seq = n.route.seq
+	} else {
+		m.seq++
+		route.seq = m.seq
+	}
+	n.route = route
+	return nil
+}
+
+// match calls fn with every route matching the topic and its params.
+func (m *levelMatcher) match(topic string, fn func(route *levelRoute, ps Params)) {
+	levels := strings.Split(topic, "/")
+	m.root.match(levels, 0, nil, fn)
+}
+
+func (n *levelNode) match(levels []string, i int, ps Params, fn func(*levelRoute, Params)) {
+	if i == len(levels) {
+		if n.route != nil {
+			fn(n.route, append(Params(nil), ps...))
+		}
+		// # also matches the parent level
+		for _, child := range n.wild {
+			if child.segment.kind == segMulti && child.route != nil {
+				fn(child.route, append(ps[:len(ps):len(ps)], Param{Key: child.segment.value}))
+			}
+		}
+		return
+	}
+	level := levels[i]
+	if child, ok := n.children[segment{value: level}.key()]; ok {
+		child.match(levels, i+1, ps, fn)
+	}
+	// topics starting with $ are not matched by a leading wildcard
+	if i == 0 && strings.HasPrefix(level, "$") {
+		return
+	}
+	for _, child := range n.wild {
+		switch child.segment.kind {
+		case segParam:
+			if child.segment.re != nil && !child.segment.re.MatchString(level) {
+				continue
+			}
+			child.match(levels, i+1, append(ps[:len(ps):len(ps)], Param{Key: child.segment.value, Value: level}), fn)
+		case segSpan:
+			// try every count of levels matching the constraint
+			for j := i + 1; j <= len(levels); j++ {
+				value := strings.Join(levels[i:j], "/")
+				if child.segment.re.MatchString(value) {
+					child.match(levels, j, append(ps[:len(ps):len(ps)], Param{Key: child.segment.value, Value: value}), fn)
+				}
+			}
+		case segMulti:
+			if child.route != nil {
+				value := strings.Join(levels[i:], "/")
+				fn(child.route, append(ps[:len(ps):len(ps)], Param{Key: child.segment.value, Value: value}))
+			}
+		}
+	}
+}
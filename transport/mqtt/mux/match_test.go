@@ -0,0 +1,256 @@
+package mux
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestMatchMQTT(t *testing.T) {
+	router := NewRouter(Mode(MatchMQTT))
+	var got []string
+	add := func(filter string) {
+		if err := router.TryHandle(filter, func(c mqtt.Client, msg mqtt.Message, ps *Params) {
+			got = append(got, filter)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, filter := range []string{
+		"sport/tennis/+",
+		"sport/#",
+		"sport/+/player1",
+		"#",
+		"+/monitor/Clients",
+		"$SYS/#",
+		"$SYS/monitor/+",
+		"/finance",
+		"+/+",
+		"a//b",
+	} {
+		add(filter)
+	}
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{"sport/tennis/player1", []string{"sport/tennis/+", "sport/+/player1", "sport/#", "#"}},
+		{"sport", []string{"sport/#", "#"}},
+		{"sport/", []string{"sport/#", "+/+", "#"}},
+		{"/finance", []string{"/finance", "+/+", "#"}},
+		{"$SYS/monitor/Clients", []string{"$SYS/monitor/+", "$SYS/#"}},
+		{"a//b", []string{"a//b", "#"}},
+		{"$share", nil},
+	}
+	for _, tt := range tests {
+		got = nil
+		router.ServeMQTT(nil, &testMessage{topic: tt.topic})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("topic %q: expected %v, got %v", tt.topic, tt.want, got)
+		}
+	}
+}
+
+func TestMatchMQTTParams(t *testing.T) {
+	router := NewRouter(Mode(MatchMQTT))
+	var got Params
+	handle := func(c mqtt.Client, msg mqtt.Message, ps *Params) { got = *ps }
+	router.Handle("$share/g1/sys/:pk/:dn/*rest", handle)
+	router.ServeMQTT(nil, &testMessage{topic: "sys/p1/d1/thing/event/post"})
+	want := Params{{"pk", "p1"}, {"dn", "d1"}, {"rest", "thing/event/post"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	route, ps, ok := router.Lookup("sys/p1/d1")
+	if !ok || route.Pattern != "sys/:pk/:dn/*rest" || !reflect.DeepEqual(route.Params, []string{"pk", "dn", "rest"}) {
+		t.Errorf("unexpected lookup %v %v", route, ok)
+	}
+	if ps.ByName("rest") != "" || ps.ByName("dn") != "d1" {
+		t.Errorf("unexpected params %v", ps)
+	}
+}
+
+func TestMatchMQTTInvalidFilter(t *testing.T) {
+	router := NewRouter(Mode(MatchMQTT))
+	noop := func(c mqtt.Client, msg mqtt.Message, ps *Params) {}
+	for _, filter := range []string{"sport/tennis#", "sport/#/ranking", "sport+", "a/*rest/b", "a/:p:q"} {
+		if err := router.TryHandle(filter, noop); err == nil {
+			t.Errorf("expected error for %q", filter)
+		}
+	}
+	if err := router.TryHandle("a/+", noop); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.TryHandle("a/+", noop); err == nil {
+		t.Error("expected duplicate error")
+	}
+	routes := router.Routes()
+	patterns := make([]string, 0, len(routes))
+	for _, r := range routes {
+		patterns = append(patterns, r.Pattern)
+	}
+	sort.Strings(patterns)
+	if !reflect.DeepEqual(patterns, []string{"a/+"}) {
+		t.Errorf("unexpected routes %v", patterns)
+	}
+}
+
+func TestMatchLevels(t *testing.T) {
+	var got []string
+	add := func(router *Router, pattern string, priority int) {
+		router.HandlePriority(pattern, priority, func(c mqtt.Client, msg mqtt.Message, ps *Params) {
+			got = append(got, pattern+" "+ps.ByName("rest"))
+		})
+	}
+	router := NewRouter(Mode(MatchLevels))
+	add(router, "/sys/:pk/*rest", 0)
+	add(router, "/sys/:pk/:dn/thing/event/post", 0)
+	add(router, "/sys/:pk/:dn/thing/event/:event", 0)
+
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		// the most specific route
+		{"sys/p1/d1/thing/event/post", []string{"/sys/:pk/:dn/thing/event/post "}},
+		{"/sys/p1/d1/thing/event/set", []string{"/sys/:pk/:dn/thing/event/:event "}},
+		{"/sys/p1/d1/thing/service/get", []string{"/sys/:pk/*rest d1/thing/service/get"}},
+		{"/ota/p1", nil},
+	}
+	for _, tt := range tests {
+		got = nil
+		router.ServeMQTT(nil, &testMessage{topic: tt.topic})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("topic %q: expected %v, got %v", tt.topic, tt.want, got)
+		}
+	}
+
+	// an explicit priority wins over the specificity
+	add(router, "/sys/:pk/*rest", 1)
+	got = nil
+	router.ServeMQTT(nil, &testMessage{topic: "/sys/p1/d1/thing/event/post"})
+	if want := []string{"/sys/:pk/*rest d1/thing/event/post"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if route, _, ok := router.Lookup("/sys/p1/d1/thing/event/post"); !ok || route.Priority != 1 {
+		t.Errorf("unexpected lookup %v %v", route, ok)
+	}
+	if len(router.Routes()) != 3 {
+		t.Errorf("expected 3 routes, got %v", router.Routes())
+	}
+
+	// fan out in priority then specificity order
+	FanOut(true)(router)
+	got = nil
+	router.ServeMQTT(nil, &testMessage{topic: "/sys/p1/d1/thing/event/post"})
+	want := []string{
+		"/sys/:pk/*rest d1/thing/event/post",
+		"/sys/:pk/:dn/thing/event/post ",
+		"/sys/:pk/:dn/thing/event/:event ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestMatchConstraints(t *testing.T) {
+	var got []string
+	add := func(router *Router, pattern string) {
+		router.Handle(pattern, func(c mqtt.Client, msg mqtt.Message, ps *Params) {
+			got = append(got, pattern)
+			for _, p := range *ps {
+				got = append(got, p.Key+"="+p.Value)
+			}
+		})
+	}
+	// the default mode falls through to the tree
+	router := NewRouter()
+	add(router, "/sys/{pk:[a-zA-Z0-9]+}/{dn}/thing/event/post")
+	add(router, "/sys/:pk/:dn/thing/event/:event")
+	add(router, "/ota/{path:fw/.*}")
+
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{"/sys/p1/d1/thing/event/post", []string{"/sys/{pk:[a-zA-Z0-9]+}/{dn}/thing/event/post", "pk=p1", "dn=d1"}},
+		{"/sys/p-1/d1/thing/event/post", []string{"/sys/:pk/:dn/thing/event/:event", "pk=p-1", "dn=d1", "event=post"}},
+		{"ota/fw/v2/app.bin", []string{"/ota/{path:fw/.*}", "path=fw/v2/app.bin"}},
+		{"ota/cfg/app.json", nil},
+	}
+	for _, tt := range tests {
+		got = nil
+		router.ServeMQTT(nil, &testMessage{topic: tt.topic})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("topic %q: expected %v, got %v", tt.topic, tt.want, got)
+		}
+	}
+	if route, ps, ok := router.Lookup("/sys/p1/d1/thing/event/post"); !ok ||
+		!reflect.DeepEqual(route.Params, []string{"pk", "dn"}) || ps.ByName("pk") != "p1" {
+		t.Errorf("unexpected lookup %v %v %v", route, ps, ok)
+	}
+
+	// the constrained wildcard is more specific
+	router = NewRouter(Mode(MatchLevels))
+	add(router, "/sys/:pk/:dn/thing/event/post")
+	add(router, "/sys/{pk:[0-9]+}/:dn/thing/event/post")
+	got = nil
+	router.ServeMQTT(nil, &testMessage{topic: "/sys/42/d1/thing/event/post"})
+	if len(got) == 0 || got[0] != "/sys/{pk:[0-9]+}/:dn/thing/event/post" {
+		t.Errorf("expected the constrained route, got %v", got)
+	}
+
+	for _, pattern := range []string{"/sys/{pk:[}/x", "/sys/{}/x", "/sys/{pk}x/y"} {
+		if err := router.TryHandle(pattern, func(c mqtt.Client, msg mqtt.Message, ps *Params) {}); err == nil {
+			t.Errorf("expected error for %q", pattern)
+		}
+	}
+}
+
+func TestMatchConstraintsOverlap(t *testing.T) {
+	var got string
+	router := NewRouter()
+	for _, pattern := range []string{
+		"/sys/{pk:[a-z]+}/*rest",
+		"/sys/abc/status",
+		"/sys/{pk:[a-z]+}/:dn/post",
+	} {
+		pattern := pattern
+		router.Handle(pattern, func(c mqtt.Client, msg mqtt.Message, ps *Params) {
+			got = pattern
+		})
+	}
+	tests := map[string]string{
+		"/sys/abc/status":    "/sys/abc/status",
+		"/sys/xyz/status":    "/sys/{pk:[a-z]+}/*rest",
+		"/sys/abc/d1/post":   "/sys/{pk:[a-z]+}/:dn/post",
+		"/sys/abc/d1/status": "/sys/{pk:[a-z]+}/*rest",
+	}
+	for topic, want := range tests {
+		got = ""
+		router.ServeMQTT(nil, &testMessage{topic: topic})
+		if got != want {
+			t.Errorf("topic %q: expected %q, got %q", topic, want, got)
+		}
+		if route, _, ok := router.Lookup(topic); !ok || route.Pattern != want {
+			t.Errorf("lookup %q: expected %q, got %v", topic, want, route)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tests := map[string]string{
+		"/sys/:pk/:dn/thing/event/post":                "/sys/+/+/thing/event/post",
+		"/sys/{pk:[a-zA-Z0-9]+}/{dn}/thing/event/post": "/sys/+/+/thing/event/post",
+		"/ota/{path:fw/.*}/done":                       "/ota/#",
+		"/ota/:pk/*path":                               "/ota/+/#",
+		"sport/+/player1":                              "sport/+/player1",
+	}
+	for pattern, want := range tests {
+		if got := Filter(pattern); got != want {
+			t.Errorf("%q: expected %q, got %q", pattern, want, got)
+		}
+	}
+}
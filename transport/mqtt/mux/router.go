@@ -31,6 +31,8 @@
 package mux
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
 
@@ -64,19 +66,50 @@ func (ps Params) ByName(name string) string {
 	return ""
 }
 
+// Dispatcher runs the matched handlers of the router, eg on a worker pool.
+// The params are not pooled and are owned by the dispatcher.
+type Dispatcher interface {
+	Dispatch(h HandlerFunc, c mqtt.Client, msg mqtt.Message, ps *Params)
+}
+
+// Route is a registered route.
+type Route struct {
+	// Pattern is the topic pattern, eg /sys/:pk/:dn/thing/event/post.
+	Pattern string
+	// Params are the param names of the pattern.
+	Params []string
+	// Priority orders the overlapping routes, see MatchLevels.
+	Priority int
+}
+
 // Router is a http.Handler which can be used to dispatch requests to different
 // handler functions via configurable routes
 type Router struct {
+	mode           MatchMode
+	fanOut         bool
 	root           *node
+	levels         levelMatcher
+	treeRoutes     map[string]*levelRoute // the specificity of the tree routes
+	routes         []Route
 	paramsPool     sync.Pool
 	maxParams      uint16
 	NotFoundHandle HandlerFunc
+	// PanicHandler handles the panics of the handlers, run on the calling
+	// goroutine or the Dispatcher, the panic is propagated if nil.
+	PanicHandler func(c mqtt.Client, msg mqtt.Message, recovered interface{})
+	// Dispatcher runs the handlers, they are run on the calling goroutine
+	// if nil.
+	Dispatcher Dispatcher
 }
 
 // New returns a new initialized Router.
 // topic auto-correction, including trailing slashes, is enabled by default.
-func NewRouter() *Router {
-	return &Router{}
+func NewRouter(opts ...RouterOption) *Router {
+	r := &Router{}
+	for _, o := range opts {
+		o(r)
+	}
+	return r
 }
 
 func (r *Router) getParams() *Params {
@@ -91,7 +124,9 @@ func (r *Router) putParams(ps *Params) {
 	}
 }
 
-// Handle registers the handler for the given pattern.
+// Handle registers the handler for the given pattern, a handler already
+// registered for the pattern is replaced. It panics on an invalid pattern or
+// a pattern conflicting with the registered routes, see TryHandle.
 func (r *Router) Handle(topic string, handle HandlerFunc) {
 	if len(topic) < 1 {
 		panic("router: topic must not be empty")
@@ -99,24 +134,73 @@ func (r *Router) Handle(topic string, handle HandlerFunc) {
 	if handle == nil {
 		panic("handle must not be nil")
 	}
-	// drop share-subscribe fields
-	if strings.HasPrefix(topic, "$share/") {
-		topic = strings.Join(strings.Split(topic, "/")[2:], "/")
+	if err := r.handle(topic, 0, handle, true); err != nil {
+		panic(err.Error())
 	}
-	topic = strings.TrimPrefix(topic, "$queue/")
-	if topic[0] != '/' {
-		// fix
-		topic = "/" + topic
+}
+
+// HandlePriority registers the handler for the given pattern like Handle,
+// with the priority ordering the overlapping routes of the level matching
+// modes, the higher first.
+func (r *Router) HandlePriority(topic string, priority int, handle HandlerFunc) {
+	if len(topic) < 1 {
+		panic("router: topic must not be empty")
+	}
+	if handle == nil {
+		panic("handle must not be nil")
+	}
+	if err := r.handle(topic, priority, handle, true); err != nil {
+		panic(err.Error())
+	}
+}
+
+// TryHandle registers the handler for the given pattern like Handle, but it
+// returns a descriptive error instead of panicking, and reports a pattern
+// already registered. The routes are left as is on error.
+func (r *Router) TryHandle(topic string, handle HandlerFunc) error {
+	if len(topic) < 1 {
+		return fmt.Errorf("router: topic must not be empty")
+	}
+	if handle == nil {
+		return fmt.Errorf("router: handle of topic %q must not be nil", topic)
+	}
+	return r.handle(topic, 0, handle, false)
+}
+
+func (r *Router) handle(topic string, priority int, handle HandlerFunc, replace bool) (err error) {
+	// the constrained routes are matched level by level in every mode
+	if r.mode != MatchHTTP || strings.Contains(topic, "{") {
+		return r.handleLevels(topic, priority, handle, replace)
+	}
+	topic = cleanPattern(topic)
+	if !replace && r.lookupRoute(topic) >= 0 {
+		return fmt.Errorf("router: a handle is already registered for topic %q", topic)
+	}
+	// add route to a copy of the tree, the tree is left as is on conflict
+	root := new(node)
+	if r.root != nil {
+		root = r.root.clone()
+	}
+	defer func() {
+		if recv := recover(); recv != nil {
+			err = fmt.Errorf("router: topic %q: %v", topic, recv)
+		}
+	}()
+	root.addRoute(topic, handle)
+	r.root = root
+	if segs, err := parseFilter(topic); err == nil {
+		if r.treeRoutes == nil {
+			r.treeRoutes = make(map[string]*levelRoute)
+		}
+		r.treeRoutes[topic] = newLevelRoute(Route{Pattern: topic, Priority: priority}, segs, handle)
 	}
-	// add route
-	varsCount := uint16(0)
-	if r.root == nil {
-		r.root = new(node)
+	if r.lookupRoute(topic) >= 0 {
+		return nil
 	}
-	r.root.addRoute(topic, handle)
+	r.routes = append(r.routes, Route{Pattern: topic, Params: paramNames(topic)})
 	// Update maxParams
-	if paramsCount := countParams(topic); paramsCount+varsCount > r.maxParams {
-		r.maxParams = paramsCount + varsCount
+	if paramsCount := countParams(topic); paramsCount > r.maxParams {
+		r.maxParams = paramsCount
 	}
 	// Lazy-init paramsPool alloc func
 	if r.paramsPool.New == nil && r.maxParams > 0 {
@@ -125,34 +209,270 @@ func (r *Router) Handle(topic string, handle HandlerFunc) {
 			return &ps
 		}
 	}
+	return nil
+}
+
+// handleLevels registers the route to the level matcher.
+func (r *Router) handleLevels(topic string, priority int, handle HandlerFunc, replace bool) error {
+	if r.mode == MatchMQTT {
+		topic = cleanFilter(topic)
+	} else {
+		topic = cleanPattern(topic)
+	}
+	segs, err := parseFilter(topic)
+	if err != nil {
+		return fmt.Errorf("router: topic %q: %v", topic, err)
+	}
+	route := Route{Pattern: topic, Priority: priority}
+	for _, seg := range segs {
+		if seg.kind != segStatic {
+			route.Params = append(route.Params, seg.value)
+		}
+	}
+	if err = r.levels.add(segs, newLevelRoute(route, segs, handle), replace); err != nil {
+		return fmt.Errorf("router: topic %q: %v", topic, err)
+	}
+	if i := r.lookupRoute(topic); i >= 0 {
+		r.routes[i] = route
+	} else {
+		r.routes = append(r.routes, route)
+	}
+	return nil
+}
+
+// Routes returns the registered routes in registration order.
+func (r *Router) Routes() []Route {
+	routes := make([]Route, len(r.routes))
+	copy(routes, r.routes)
+	return routes
+}
+
+// Lookup returns the route matching the topic and its params without
+// dispatching.
+func (r *Router) Lookup(topic string) (Route, Params, bool) {
+	var matches []levelMatch
+	if r.mode != MatchHTTP || r.levels.seq > 0 {
+		matches = r.matchLevels(topic)
+		if r.mode != MatchHTTP {
+			if len(matches) > 0 {
+				return matches[0].route.route, matches[0].ps, true
+			}
+			return Route{}, nil, false
+		}
+	}
+	var (
+		leaf *node
+		ps   *Params
+	)
+	if r.root != nil && topic != "" {
+		leaf, ps, _ = r.root.lookup(fixTopic(topic), func() *Params {
+			ps := make(Params, 0, r.maxParams)
+			return &ps
+		})
+	}
+	if len(matches) > 0 && !r.treeBefore(leaf, matches[0].route) {
+		return matches[0].route.route, matches[0].ps, true
+	}
+	if leaf == nil {
+		return Route{}, nil, false
+	}
+	var params Params
+	if ps != nil {
+		params = *ps
+	}
+	if i := r.lookupRoute(leaf.fullPath); i >= 0 {
+		return r.routes[i], params, true
+	}
+	return Route{Pattern: leaf.fullPath, Params: paramNames(leaf.fullPath)}, params, true
+}
+
+func (r *Router) lookupRoute(pattern string) int {
+	for i, route := range r.routes {
+		if route.Pattern == pattern {
+			return i
+		}
+	}
+	return -1
+}
+
+// cleanFilter drops the share-subscribe fields.
+func cleanFilter(topic string) string {
+	if strings.HasPrefix(topic, "$share/") {
+		topic = strings.Join(strings.Split(topic, "/")[2:], "/")
+	}
+	return strings.TrimPrefix(topic, "$queue/")
+}
+
+// cleanPattern drops the share-subscribe fields and fixes the leading '/'.
+func cleanPattern(topic string) string {
+	topic = cleanFilter(topic)
+	if len(topic) == 0 || topic[0] != '/' {
+		// fix
+		topic = "/" + topic
+	}
+	return topic
+}
+
+func paramNames(pattern string) []string {
+	var names []string
+	for _, dir := range strings.Split(pattern, "/") {
+		if i := strings.IndexAny(dir, ":*"); i >= 0 {
+			names = append(names, dir[i+1:])
+		}
+	}
+	return names
+}
+
+type levelMatch struct {
+	route *levelRoute
+	ps    Params
+}
+
+// matchLevels returns the routes of the level matcher matching the topic in
+// serving order.
+func (r *Router) matchLevels(topic string) []levelMatch {
+	if r.mode != MatchMQTT && topic != "" {
+		topic = fixTopic(topic)
+	}
+	var matches []levelMatch
+	r.levels.match(topic, func(route *levelRoute, ps Params) {
+		matches = append(matches, levelMatch{route: route, ps: ps})
+	})
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].route.before(matches[j].route)
+	})
+	return matches
+}
+
+// treeBefore reports whether the route of the tree leaf is served before the
+// constrained route, see levelRoute.before.
+func (r *Router) treeBefore(leaf *node, route *levelRoute) bool {
+	if leaf == nil {
+		return false
+	}
+	tr, ok := r.treeRoutes[leaf.fullPath]
+	return ok && tr.before(route)
+}
+
+// fixTopic adds the leading '/' of the MatchHTTP topics.
+func fixTopic(topic string) string {
+	if topic[0] != '/' {
+		// fix
+		topic = "/" + topic
+	}
+	return topic
 }
 
 // ServeMQTT makes the router implement the mqtt.MessageHandle interface.
+// Every call routes the message, fanning it out with FanOut, and the clients
+// call the handler of every subscribed filter matching a message: a router
+// subscribed with overlapping filters must be called once per message.
 func (r *Router) ServeMQTT(c mqtt.Client, msg mqtt.Message) {
+	if r.mode != MatchHTTP {
+		r.serveLevels(c, msg)
+		return
+	}
 	topic := msg.Topic()
 	if topic[0] != '/' {
 		// fix
 		topic = "/" + topic
 	}
-	if r.root == nil {
+	var (
+		leaf *node
+		ps   *Params
+	)
+	if r.root != nil {
+		leaf, ps, _ = r.root.lookup(topic, r.getParams)
+	}
+	// the constrained routes served unless the tree route is more specific
+	if r.levels.seq > 0 {
+		if matches := r.matchLevels(topic); len(matches) > 0 && !r.treeBefore(leaf, matches[0].route) {
+			r.putParams(ps)
+			r.serveMatches(c, msg, matches)
+			return
+		}
+	}
+	if leaf == nil {
+		r.putParams(ps)
 		if r.NotFoundHandle != nil {
 			r.NotFoundHandle(c, msg, nil)
 		}
 		return
 	}
-	handle, ps, _ := r.root.getValue(topic, r.getParams)
-	if handle == nil {
+	handle := leaf.handle
+
+	if r.Dispatcher != nil {
+		var params *Params
+		if ps != nil {
+			cp := make(Params, len(*ps))
+			copy(cp, *ps)
+			r.putParams(ps)
+			params = &cp
+		}
+		r.Dispatcher.Dispatch(r.recovered(handle), c, msg, params)
+		return
+	}
+
+	if ps != nil {
+		// note: handle must before putParams
+		defer r.putParams(ps)
+	}
+	if r.PanicHandler != nil {
+		defer r.recv(c, msg)
+	}
+	handle(c, msg, ps)
+}
+
+func (r *Router) recv(c mqtt.Client, msg mqtt.Message) {
+	if rcv := recover(); rcv != nil {
+		r.PanicHandler(c, msg, rcv)
+	}
+}
+
+// serveLevels delivers the message to the first matching route of the level
+// matcher, or every one with FanOut.
+func (r *Router) serveLevels(c mqtt.Client, msg mqtt.Message) {
+	matches := r.matchLevels(msg.Topic())
+	if len(matches) == 0 {
 		if r.NotFoundHandle != nil {
 			r.NotFoundHandle(c, msg, nil)
 		}
 		return
 	}
+	r.serveMatches(c, msg, matches)
+}
 
-	if ps != nil {
+// serveMatches delivers the message to the first match, or every one with
+// FanOut.
+func (r *Router) serveMatches(c mqtt.Client, msg mqtt.Message, matches []levelMatch) {
+	if !r.fanOut {
+		matches = matches[:1]
+	}
+	for _, m := range matches {
+		ps := m.ps
+		if r.Dispatcher != nil {
+			r.Dispatcher.Dispatch(r.recovered(m.route.handle), c, msg, &ps)
+			continue
+		}
+		r.call(m.route.handle, c, msg, &ps)
+	}
+}
+
+// recovered wraps the handle run by the Dispatcher with the PanicHandler.
+func (r *Router) recovered(handle HandlerFunc) HandlerFunc {
+	if r.PanicHandler == nil {
+		return handle
+	}
+	return func(c mqtt.Client, msg mqtt.Message, ps *Params) {
+		defer r.recv(c, msg)
 		handle(c, msg, ps)
-		// note: handle must before putParams
-		r.putParams(ps)
-	} else {
-		handle(c, msg, nil)
 	}
 }
+
+// call runs the handle, a panic is recovered so the other routes are served.
+func (r *Router) call(handle HandlerFunc, c mqtt.Client, msg mqtt.Message, ps *Params) {
+	if r.PanicHandler != nil {
+		defer r.recv(c, msg)
+	}
+	handle(c, msg, ps)
+}
@@ -5,9 +5,25 @@
 package mux
 
 import (
+	"reflect"
+	"strings"
 	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+type testMessage struct {
+	topic string
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return 0 }
+func (m *testMessage) Retained() bool    { return false }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 0 }
+func (m *testMessage) Payload() []byte   { return nil }
+func (m *testMessage) Ack()              {}
+
 func TestParams(t *testing.T) {
 	ps := Params{
 		Param{"param1", "value1"},
@@ -23,3 +39,81 @@ func TestParams(t *testing.T) {
 		t.Errorf("Expected empty string for not found key; got: %s", val)
 	}
 }
+
+func TestRouterPanicHandler(t *testing.T) {
+	router := NewRouter()
+	router.Handle("/sys/:pk/panic", func(c mqtt.Client, msg mqtt.Message, ps *Params) {
+		panic("oops")
+	})
+	var recovered interface{}
+	router.PanicHandler = func(c mqtt.Client, msg mqtt.Message, rcv interface{}) {
+		recovered = rcv
+	}
+	router.ServeMQTT(nil, &testMessage{topic: "/sys/pk/panic"})
+	if recovered != "oops" {
+		t.Fatalf("expected panic recovered, got %v", recovered)
+	}
+}
+
+func TestRouterRoutesAndLookup(t *testing.T) {
+	router := NewRouter()
+	noop := func(c mqtt.Client, msg mqtt.Message, ps *Params) {}
+	router.Handle("/sys/:pk/:dn/thing/event/post", noop)
+	router.Handle("$share/g1/ota/:pk/*path", noop)
+	router.Handle("/sys/:pk/:dn/thing/event/post", noop)
+
+	want := []Route{
+		{Pattern: "/sys/:pk/:dn/thing/event/post", Params: []string{"pk", "dn"}},
+		{Pattern: "/ota/:pk/*path", Params: []string{"pk", "path"}},
+	}
+	if got := router.Routes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected routes %v, got %v", want, got)
+	}
+
+	route, ps, ok := router.Lookup("/sys/p1/d1/thing/event/post")
+	if !ok || route.Pattern != want[0].Pattern {
+		t.Fatalf("expected %s matched, got %v %v", want[0].Pattern, route, ok)
+	}
+	if !reflect.DeepEqual(ps, Params{{"pk", "p1"}, {"dn", "d1"}}) {
+		t.Errorf("unexpected params %v", ps)
+	}
+	route, ps, ok = router.Lookup("ota/p1/fw/v2.bin")
+	if !ok || route.Pattern != want[1].Pattern || ps.ByName("path") != "/fw/v2.bin" {
+		t.Errorf("unexpected lookup %v %v %v", route, ps, ok)
+	}
+	if _, _, ok = router.Lookup("/sys/p1/d1/thing/event"); ok {
+		t.Error("expected no match")
+	}
+}
+
+func TestRouterTryHandle(t *testing.T) {
+	router := NewRouter()
+	noop := func(c mqtt.Client, msg mqtt.Message, ps *Params) {}
+	if err := router.TryHandle("/sys/:pk/:dn/thing/event/post", noop); err != nil {
+		t.Fatal(err)
+	}
+	tests := []string{
+		"/sys/:pk/:dn/thing/event/post", // duplicate
+		"/sys/:product/:dn/thing/event/post",
+		"/sys/:pk/*all",
+		"/sys/:pk/:/x",
+		"",
+	}
+	for _, topic := range tests {
+		err := router.TryHandle(topic, noop)
+		if err == nil {
+			t.Errorf("expected error for %q", topic)
+			continue
+		}
+		if topic != "" && !strings.Contains(err.Error(), topic) {
+			t.Errorf("expected the topic in error, got %v", err)
+		}
+	}
+	// the tree is intact
+	if _, _, ok := router.Lookup("/sys/p1/d1/thing/event/post"); !ok {
+		t.Error("expected route still matched")
+	}
+	if len(router.Routes()) != 1 {
+		t.Errorf("expected 1 route, got %v", router.Routes())
+	}
+}
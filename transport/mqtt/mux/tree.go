@@ -79,6 +79,17 @@ type node struct {
 	priority  uint32
 	children  []*node
 	handle    HandlerFunc
+	fullPath  string // the route pattern of the handle
+}
+
+// clone returns a deep copy of the tree.
+func (n *node) clone() *node {
+	c := *n
+	c.children = make([]*node, len(n.children))
+	for i, child := range n.children {
+		c.children[i] = child.clone()
+	}
+	return &c
 }
 
 // Increments priority of the given child and reorders if necessary
@@ -133,6 +144,7 @@ walk:
 				indices:   n.indices,
 				children:  n.children,
 				handle:    n.handle,
+				fullPath:  n.fullPath,
 				priority:  n.priority - 1,
 			}
 
@@ -141,6 +153,7 @@ walk:
 			n.indices = string([]byte{n.path[i]})
 			n.path = path[:i]
 			n.handle = nil
+			n.fullPath = ""
 			n.wildChild = false
 		}
 
@@ -210,6 +223,7 @@ walk:
 		// 	panic("a handle is already registered for path '" + fullPath + "'")
 		// }
 		n.handle = handle
+		n.fullPath = fullPath
 		return
 	}
 }
@@ -271,6 +285,7 @@ func (n *node) insertChild(path, fullPath string, handle HandlerFunc) {
 
 			// Otherwise we're done. Insert the handle in the new leaf
 			n.handle = handle
+			n.fullPath = fullPath
 			return
 		}
 
@@ -306,6 +321,7 @@ func (n *node) insertChild(path, fullPath string, handle HandlerFunc) {
 			path:     path[i:],
 			nType:    catchAll,
 			handle:   handle,
+			fullPath: fullPath,
 			priority: 1,
 		}
 		n.children = []*node{child}
@@ -316,6 +332,7 @@ func (n *node) insertChild(path, fullPath string, handle HandlerFunc) {
 	// If no wildcard was found, simply insert the path and handle
 	n.path = path
 	n.handle = handle
+	n.fullPath = fullPath
 }
 
 // Returns the handle registered with the given path (key). The values of
@@ -324,6 +341,16 @@ func (n *node) insertChild(path, fullPath string, handle HandlerFunc) {
 // made if a handle exists with an extra (without the) trailing slash for the
 // given path.
 func (n *node) getValue(path string, params func() *Params) (handle HandlerFunc, ps *Params, tsr bool) {
+	leaf, ps, tsr := n.lookup(path, params)
+	if leaf != nil {
+		handle = leaf.handle
+	}
+	return
+}
+
+// lookup returns the node holding the handle registered with the given path,
+// see getValue.
+func (n *node) lookup(path string, params func() *Params) (leaf *node, ps *Params, tsr bool) {
 walk: // Outer loop for walking the tree
 	for {
 		prefix := n.path
@@ -387,7 +414,8 @@ walk: // Outer loop for walking the tree
 						return
 					}
 
-					if handle = n.handle; handle != nil {
+					if n.handle != nil {
+						leaf = n
 						return
 					} else if len(n.children) == 1 {
 						// No handle found. Check if a handle for this path + a
@@ -413,7 +441,9 @@ walk: // Outer loop for walking the tree
 						}
 					}
 
-					handle = n.handle
+					if n.handle != nil {
+						leaf = n
+					}
 					return
 
 				default:
@@ -423,7 +453,8 @@ walk: // Outer loop for walking the tree
 		} else if path == prefix {
 			// We should have reached the node containing the handle.
 			// Check if this node has a handle registered.
-			if handle = n.handle; handle != nil {
+			if n.handle != nil {
+				leaf = n
 				return
 			}
 
@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"context"
+	"strings"
+
+	"github.com/eclipse/paho.golang/paho"
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/encoding/json"
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/transport"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PublishOption is a publish option.
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	qos         byte
+	retain      bool
+	contentType string
+}
+
+// PublishQos with the qos of the published message.
+func PublishQos(qos byte) PublishOption {
+	return func(o *publishOptions) {
+		o.qos = qos
+	}
+}
+
+// PublishRetain with the retain flag of the published message.
+func PublishRetain(retain bool) PublishOption {
+	return func(o *publishOptions) {
+		o.retain = retain
+	}
+}
+
+// PublishContentType with the content type of the published message, its
+// subtype picks the codec, eg application/json or application/proto.
+func PublishContentType(contentType string) PublishOption {
+	return func(o *publishOptions) {
+		o.contentType = contentType
+	}
+}
+
+// PublishEncoder with publish encoder.
+func PublishEncoder(enc EncodeRequestFunc) ServerOption {
+	return func(o *Server) {
+		o.encPublish = enc
+	}
+}
+
+// PublishMiddleware with client middleware run by Publish.
+func PublishMiddleware(m ...middleware.Middleware) ServerOption {
+	return func(o *Server) {
+		o.publishMs = m
+	}
+}
+
+// DefaultPublishEncoder encodes the object with the codec of the Content-Type
+// request header subtype, see GetCodec, json by default. A []byte is
+// published as is.
+func DefaultPublishEncoder(ctx context.Context, v interface{}) ([]byte, error) {
+	if body, ok := v.([]byte); ok {
+		return body, nil
+	}
+	name := json.Name
+	if tr, ok := transport.FromClientContext(ctx); ok {
+		if subtype := contentSubtype(tr.RequestHeader().Get("Content-Type")); subtype != "" {
+			name = subtype
+		}
+	}
+	codec := GetCodec(name)
+	if codec == nil {
+		return nil, errors.BadRequest("CODEC", "unregistered codec: "+name)
+	}
+	return codec.Marshal(v)
+}
+
+// Publish encodes v with the publish encoder and publishes it to the topic,
+// it runs the publish middleware and waits for the broker until the ctx is
+// done, or like PublishReply when called by a handler. The request header
+// is carried by the MQTT v5 user properties, by the HeaderEncoder in the
+// MQTT 3.1.1 payload, and is dropped without one.
+func (s *Server) Publish(ctx context.Context, topic string, v interface{}, opts ...PublishOption) error {
+	var o publishOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	tr := &Transport{
+		endpoint:    s.endpoint,
+		operation:   topic,
+		topic:       topic,
+		reqHeader:   headerCarrier{},
+		replyHeader: headerCarrier{},
+	}
+	if o.contentType != "" {
+		tr.reqHeader.Set("Content-Type", o.contentType)
+	}
+	ctx = transport.NewClientContext(ctx, tr)
+	if s.tracer != nil {
+		var span trace.Span
+		ctx, span = startProducerSpan(ctx, s.tracer, s.propagator, tr)
+		defer span.End()
+	}
+	h := func(ctx context.Context, in interface{}) (interface{}, error) {
+		return nil, s.publish(ctx, tr, &o, in)
+	}
+	if len(s.publishMs) > 0 {
+		h = middleware.Chain(s.publishMs...)(h)
+	}
+	_, err := h(ctx, v)
+	spanError(ctx, err)
+	return err
+}
+
+func (s *Server) publish(ctx context.Context, tr *Transport, o *publishOptions, v interface{}) error {
+	body, err := s.encPublish(ctx, v)
+	if err != nil {
+		return err
+	}
+	s.log.Debugf("[mqtt] publish topic:%v,body: %v", tr.topic, string(body))
+	var token pmqtt.Token
+	if v5, ok := s.mqttClient.(*v5Client); ok {
+		props := &paho.PublishProperties{ContentType: tr.reqHeader.Get("Content-Type")}
+		for _, k := range tr.reqHeader.Keys() {
+			props.User.Add(k, tr.reqHeader.Get(k))
+		}
+		token = v5.PublishProperties(tr.topic, o.qos, o.retain, body, props)
+	} else {
+		if s.encHeader != nil {
+			if body, err = s.encHeader(tr.reqHeader, body); err != nil {
+				return err
+			}
+		}
+		token = s.mqttClient.Publish(tr.topic, o.qos, o.retain, body)
+	}
+	if _, ok := ctx.Value(waitKey{}).(*publishWait); !ok {
+		// tracked by waitPublish in a handler
+		s.pending.track(token)
+	}
+	return waitPublish(ctx, tr.topic, token)
+}
+
+// contentSubtype returns the subtype of the content type, eg json for
+// application/json; charset=utf-8.
+func contentSubtype(contentType string) string {
+	left := strings.Index(contentType, "/")
+	if left == -1 {
+		return ""
+	}
+	right := strings.Index(contentType, ";")
+	if right == -1 {
+		right = len(contentType)
+	}
+	if right < left {
+		return ""
+	}
+	return strings.TrimSpace(contentType[left+1 : right])
+}
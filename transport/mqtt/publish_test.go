@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/transport"
+)
+
+func TestServerPublish(t *testing.T) {
+	var operation string
+	srv := NewServer(PublishMiddleware(func(h middleware.Handler) middleware.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			if tr, ok := transport.FromClientContext(ctx); ok {
+				operation = tr.Operation()
+			}
+			return h(ctx, req)
+		}
+	}))
+	c := &testClient{connected: true}
+	srv.mqttClient = c
+	topic := "/device/pk/dn/thing/service/property/set"
+	err := srv.Publish(context.Background(), topic, &testData{Path: "a"},
+		PublishQos(1), PublishRetain(true), PublishContentType("application/json; charset=utf-8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if operation != topic {
+		t.Errorf("expected middleware operation %s, got %s", topic, operation)
+	}
+	if len(c.pubs) != 1 {
+		t.Fatalf("expected 1 publish, got %v", c.pubs)
+	}
+	p := c.pubs[0]
+	if p.topic != topic || p.qos != 1 || !p.retained || string(p.payload) != `{"path":"a"}` {
+		t.Errorf("unexpected publish %+v %s", p, p.payload)
+	}
+
+	if err = srv.Publish(context.Background(), topic, []byte("raw")); err != nil {
+		t.Fatal(err)
+	}
+	if string(c.pubs[1].payload) != "raw" {
+		t.Errorf("expected raw payload, got %s", c.pubs[1].payload)
+	}
+
+	if err = srv.Publish(context.Background(), topic, &testData{}, PublishContentType("application/unknown")); err == nil {
+		t.Error("expected unregistered codec error")
+	}
+}
+
+func TestContentSubtype(t *testing.T) {
+	tests := map[string]string{
+		"application/json":                "json",
+		"application/proto":               "proto",
+		"application/json; charset=utf-8": "json",
+		"text":                            "",
+		"":                                "",
+	}
+	for in, want := range tests {
+		if got := contentSubtype(in); got != want {
+			t.Errorf("contentSubtype(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestServerPublishFromHandler(t *testing.T) {
+	srv := NewServer()
+	c := &testClient{connected: true, hang: true}
+	srv.mqttClient = c
+	var err error
+	srv.Route().Handle("/sys/:pk/:dn/thing/event/post", func(ctx Context) {
+		err = srv.Publish(ctx, "/device/pk/dn/thing/service/property/set", []byte("{}"), PublishQos(1))
+	})
+	done := make(chan struct{})
+	go func() {
+		srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/event/post"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the publish not waited on the ordered callback goroutine")
+	}
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestServerPublishHeader(t *testing.T) {
+	srv := NewServer(HeaderEncoder(EnvelopeHeaderEncoder("header")))
+	c := &testClient{connected: true}
+	srv.mqttClient = c
+	err := srv.Publish(context.Background(), "/device/pk/dn/thing/service/property/set", &testData{Path: "a"},
+		PublishContentType("application/json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"path":"a","header":{"Content-Type":"application/json"}}`; string(c.pubs[0].payload) != want {
+		t.Errorf("expected %s, got %s", want, c.pubs[0].payload)
+	}
+}
@@ -0,0 +1,33 @@
+package mqtt
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/go-kratos/kratos/v2/errors"
+)
+
+// PanicHandlerFunc handles a panic recovered from the handler of the message
+// in ctx.
+type PanicHandlerFunc func(ctx Context, recovered interface{})
+
+// recoverPanic logs the panic of a route handler, sends the message to the
+// dead letter sink and calls the panic handler, the connection is kept.
+func (s *Server) recoverPanic(ctx Context, rcv interface{}) {
+	msg := ctx.Message()
+	s.log.Errorf("[mqtt] panic topic: %s, %v: %s", msg.Topic(), rcv, stack())
+	s.sendDeadLetter(ctx, msg, ReasonPanic, fmt.Errorf("panic: %v", rcv))
+	if s.panicHandler != nil {
+		s.panicHandler(ctx, rcv)
+	}
+	if s.panicReply {
+		if err := ctx.ReplyErr(errors.InternalServer("PANIC", fmt.Sprint(rcv))); err != nil {
+			s.log.Errorf("[mqtt] panic reply topic: %s error(%v)", msg.Topic(), err)
+		}
+	}
+}
+
+func stack() []byte {
+	buf := make([]byte, 64<<10)
+	return buf[:runtime.Stack(buf, false)]
+}
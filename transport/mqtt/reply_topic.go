@@ -0,0 +1,43 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bytectl/gopkg/tsl/topic"
+)
+
+const (
+	ServerTopicPrefix = "/sys"
+	DeviceTopicPrefix = "/device"
+)
+
+// ReplyTopicFunc returns the reply topic of a request topic.
+type ReplyTopicFunc func(topic string) string
+
+// DefaultReplyTopic swaps the ServerTopicPrefix and DeviceTopicPrefix of the
+// topic and appends _reply, eg /sys/pk/dn/get to /device/pk/dn/get_reply.
+// Other topics are replied on the topic itself.
+func DefaultReplyTopic(topic string) string {
+	replyTopic := topic
+	if strings.HasPrefix(topic, ServerTopicPrefix) {
+		replyTopic = strings.TrimPrefix(topic, ServerTopicPrefix)
+		replyTopic = fmt.Sprintf("%s%s_reply", DeviceTopicPrefix, replyTopic)
+	} else if strings.HasPrefix(topic, DeviceTopicPrefix) {
+		replyTopic = strings.TrimPrefix(topic, DeviceTopicPrefix)
+		replyTopic = fmt.Sprintf("%s%s_reply", ServerTopicPrefix, replyTopic)
+	}
+	return replyTopic
+}
+
+// TSLReplyTopic appends the tsl/topic reply level to the topic, eg
+// /sys/pk/dn/thing/event/post to /sys/pk/dn/thing/event/post/reply.
+func TSLReplyTopic(t string) string {
+	return t + "/" + topic.TopicReplySuffix
+}
+
+// AliyunReplyTopic appends _reply to the topic, eg
+// /sys/pk/dn/thing/service/{id} to /sys/pk/dn/thing/service/{id}_reply.
+func AliyunReplyTopic(t string) string {
+	return t + "_" + topic.TopicReplySuffix
+}
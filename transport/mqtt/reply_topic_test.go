@@ -0,0 +1,35 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/bytectl/gopkg/tsl/topic"
+)
+
+func TestReplyTopicFunc(t *testing.T) {
+	tests := []struct {
+		f     ReplyTopicFunc
+		topic string
+		want  string
+		tsl   bool // parsed as a reply by tsl/topic
+	}{
+		{DefaultReplyTopic, "/sys/pk/dn/thing/event/post", "/device/pk/dn/thing/event/post_reply", false},
+		{DefaultReplyTopic, "/device/pk/dn/thing/service/set", "/sys/pk/dn/thing/service/set_reply", true},
+		{DefaultReplyTopic, "/other/pk", "/other/pk", false},
+		{TSLReplyTopic, "/sys/pk/dn/thing/event/post", "/sys/pk/dn/thing/event/post/reply", true},
+		{TSLReplyTopic, "/ext/session/pk/dn/combine/login", "/ext/session/pk/dn/combine/login/reply", true},
+		{AliyunReplyTopic, "/sys/pk/dn/thing/service/reboot", "/sys/pk/dn/thing/service/reboot_reply", true},
+	}
+	for _, tt := range tests {
+		got := tt.f(tt.topic)
+		if got != tt.want {
+			t.Errorf("reply topic of %s: expected %s, got %s", tt.topic, tt.want, got)
+		}
+		if !tt.tsl {
+			continue
+		}
+		if tp, err := topic.ParseTopic(got); err != nil || !tp.IsReply {
+			t.Errorf("expected %s parsed as reply, got %+v %v", got, tp, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/encoding"
+	kjson "github.com/go-kratos/kratos/v2/encoding/json"
+	"github.com/go-kratos/kratos/v2/transport"
+)
+
+// RequestIDFunc extracts the request id of a received message, ctx carries
+// the server transport.
+type RequestIDFunc func(ctx context.Context, msg pmqtt.Message) string
+
+// PayloadRequestID reads the request id from the field of a JSON payload, eg
+// the id of tsl.EntityRequest. The id is echoed in that field, see
+// RouteOmitRequestID.
+func PayloadRequestID(field string) RequestIDFunc {
+	return func(ctx context.Context, msg pmqtt.Message) string {
+		id, raw := payloadID(msg.Payload(), field)
+		if raw == nil {
+			return ""
+		}
+		if src, ok := ctx.Value(requestIDSourceKey{}).(*requestIDSource); ok {
+			src.field, src.raw = field, raw
+		}
+		return id
+	}
+}
+
+// payloadID returns the id in the field of a JSON payload and its JSON value,
+// a nil value when the payload has no such field.
+func payloadID(payload []byte, field string) (string, json.RawMessage) {
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return "", nil
+	}
+	raw, ok := envelope[field]
+	if !ok {
+		return "", nil
+	}
+	var id string
+	if err := json.Unmarshal(raw, &id); err != nil {
+		// a number id
+		return strings.TrimSpace(string(raw)), raw
+	}
+	return id, raw
+}
+
+// HeaderRequestID reads the request id from the request header, eg an MQTT
+// v5 user property.
+func HeaderRequestID(key string) RequestIDFunc {
+	return func(ctx context.Context, _ pmqtt.Message) string {
+		if tr, ok := transport.FromServerContext(ctx); ok {
+			return tr.RequestHeader().Get(key)
+		}
+		return ""
+	}
+}
+
+// RequestIDExtractor with the request id extractor, defaults to
+// PayloadRequestID("id"), nil extracts none. The extractor runs once per
+// message on the first RequestIDFromContext, eg when the reply is encoded.
+func RequestIDExtractor(f RequestIDFunc) ServerOption {
+	return func(o *Server) {
+		o.requestID = f
+	}
+}
+
+type requestIDKey struct{}
+
+type requestIDSourceKey struct{}
+
+// requestID is the request id of a message, extracted on first use.
+type requestID struct {
+	once sync.Once
+	f    RequestIDFunc
+	ctx  context.Context
+	msg  pmqtt.Message
+	id   string
+	src  requestIDSource
+}
+
+// withRequestID returns a new Context extracting the request id of the
+// message with f on first use.
+func withRequestID(ctx context.Context, f RequestIDFunc, msg pmqtt.Message) context.Context {
+	r := &requestID{f: f, msg: msg}
+	r.ctx = context.WithValue(ctx, requestIDSourceKey{}, &r.src)
+	return context.WithValue(ctx, requestIDKey{}, r)
+}
+
+func (r *requestID) get() string {
+	r.once.Do(func() {
+		if r.f != nil {
+			r.id = r.f(r.ctx, r.msg)
+		}
+		r.ctx, r.msg = nil, nil
+	})
+	return r.id
+}
+
+// requestIDSource is the payload field and JSON value the request id of a
+// message was read from.
+type requestIDSource struct {
+	field string
+	raw   json.RawMessage
+}
+
+// NewRequestIDContext returns a new Context that carries the request id.
+func NewRequestIDContext(ctx context.Context, id string) context.Context {
+	r := &requestID{id: id}
+	r.once.Do(func() {})
+	return context.WithValue(ctx, requestIDKey{}, r)
+}
+
+// RequestIDFromContext returns the request id of the message handled in ctx,
+// extracting it on the first call.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	r, ok := ctx.Value(requestIDKey{}).(*requestID)
+	if !ok {
+		return "", false
+	}
+	id := r.get()
+	return id, id != ""
+}
+
+// echoRequestID sets the request id to the JSON reply object, in the payload
+// field the id was read from, id by default, with its JSON type. A reply with
+// an id of its own, or of a route omitting it, is kept.
+func echoRequestID(ctx context.Context, codec encoding.Codec, body []byte) []byte {
+	if route, ok := ctx.Value(routeKey{}).(*routeOptions); !ok || route.omitID || codec.Name() != kjson.Name {
+		return body
+	}
+	id, ok := RequestIDFromContext(ctx)
+	if !ok {
+		return body
+	}
+	field, raw := "id", json.RawMessage(nil)
+	if r := ctx.Value(requestIDKey{}).(*requestID); r.src.field != "" {
+		field, raw = r.src.field, r.src.raw
+	}
+	if raw == nil {
+		raw, _ = json.Marshal(id)
+	}
+	var reply map[string]json.RawMessage
+	if err := json.Unmarshal(body, &reply); err != nil || reply == nil {
+		return body
+	}
+	if v, ok := reply[field]; ok && string(v) != `""` && string(v) != "null" {
+		return body
+	}
+	b, err := setJSONField(body, field, raw)
+	if err != nil {
+		return body
+	}
+	return b
+}
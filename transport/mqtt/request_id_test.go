@@ -0,0 +1,109 @@
+package mqtt
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/transport"
+)
+
+func TestPayloadRequestID(t *testing.T) {
+	tests := map[string]string{
+		`{"id":"123","method":"thing.event.post"}`: "123",
+		`{"id":456}`:                    "456",
+		`{"method":"thing.event.post"}`: "",
+		`not json`:                      "",
+	}
+	for payload, want := range tests {
+		got := PayloadRequestID("id")(context.Background(), &testMessage{payload: []byte(payload)})
+		if got != want {
+			t.Errorf("request id of %s: expected %q, got %q", payload, want, got)
+		}
+	}
+}
+
+func TestHeaderRequestID(t *testing.T) {
+	tr := &Transport{reqHeader: headerCarrier{}}
+	tr.reqHeader.Set("X-Request-ID", "abc")
+	ctx := transport.NewServerContext(context.Background(), tr)
+	if got := HeaderRequestID("x-request-id")(ctx, &testMessage{}); got != "abc" {
+		t.Errorf("expected abc, got %q", got)
+	}
+}
+
+func TestRouterEchoRequestID(t *testing.T) {
+	srv := NewServer()
+	c := &testClient{connected: true}
+	var id string
+	r := srv.Route()
+	r.Handle("/sys/:pk/:dn/thing/event/post", func(ctx Context) {
+		id, _ = RequestIDFromContext(ctx)
+		_ = ctx.Reply(&testData{Path: "ok"})
+	})
+	r.Handle("/sys/:pk/:dn/thing/service/:id", func(ctx Context) {
+		_ = ctx.ReplyErr(errors.New(500, "FAIL", "fail"))
+	})
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/event/post", payload: []byte(`{"id":"7"}`)})
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/service/reboot", payload: []byte(`{"id":"8"}`)})
+	if id != "7" {
+		t.Errorf("expected request id 7 in context, got %q", id)
+	}
+	if len(c.pubs) != 2 {
+		t.Fatalf("expected 2 replies, got %v", c.pubs)
+	}
+	if got := string(c.pubs[0].payload); got != `{"path":"ok","id":"7"}` {
+		t.Errorf("expected id echoed in reply, got %s", got)
+	}
+	if got := string(c.pubs[1].payload); !strings.Contains(got, `"id":"8"`) {
+		t.Errorf("expected id echoed in error reply, got %s", got)
+	}
+}
+
+func TestRouterEchoRequestIDField(t *testing.T) {
+	srv := NewServer(RequestIDExtractor(PayloadRequestID("msgId")))
+	c := &testClient{connected: true}
+	reply := func(ctx Context) { _ = ctx.Reply(map[string]string{"path": "ok"}) }
+	r := srv.Route()
+	r.Handle("/sys/:pk/:dn/thing/event/post", reply)
+	r.Handle("/sys/:pk/:dn/thing/event/set", reply, RouteOmitRequestID())
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/event/post", payload: []byte(`{"msgId":42}`)})
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/event/set", payload: []byte(`{"msgId":43}`)})
+	if len(c.pubs) != 2 {
+		t.Fatalf("expected 2 replies, got %v", c.pubs)
+	}
+	if got := string(c.pubs[0].payload); got != `{"path":"ok","msgId":42}` {
+		t.Errorf("expected the number id echoed in msgId, got %s", got)
+	}
+	if got := string(c.pubs[1].payload); got != `{"path":"ok"}` {
+		t.Errorf("expected the id omitted, got %s", got)
+	}
+}
+
+func TestRequestIDLazy(t *testing.T) {
+	var calls int
+	srv := NewServer(RequestIDExtractor(func(ctx context.Context, msg pmqtt.Message) string {
+		calls++
+		return PayloadRequestID("id")(ctx, msg)
+	}))
+	c := &testClient{connected: true}
+	r := srv.Route()
+	r.Handle("/sys/:pk/:dn/thing/event/post", func(ctx Context) {})
+	r.Handle("/sys/:pk/:dn/thing/event/set", func(ctx Context) {
+		_, _ = RequestIDFromContext(ctx)
+		_ = ctx.Reply(&testData{Path: "ok"})
+	})
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/event/post", payload: []byte(`{"id":"1"}`)})
+	if calls != 0 {
+		t.Errorf("expected no extraction without a reply, got %d", calls)
+	}
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/event/set", payload: []byte(`{"id":"2"}`)})
+	if calls != 1 {
+		t.Errorf("expected one extraction per message, got %d", calls)
+	}
+	if got := string(c.pubs[0].payload); got != `{"path":"ok","id":"2"}` {
+		t.Errorf("expected id echoed in reply, got %s", got)
+	}
+}
@@ -3,9 +3,13 @@ package mqtt
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/bytectl/gopkg/transport/mqtt/mux"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/transport"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // HandlerFunc defines a function to serve MQTT requests.
@@ -13,13 +17,17 @@ type HandlerFunc func(Context)
 
 // Router is an MQTT router.
 type Router struct {
-	pool sync.Pool
-	srv  *Server
+	pool   sync.Pool
+	srv    *Server
+	prefix string
+	ms     []middleware.Middleware
 }
 
-func newRouter(srv *Server) *Router {
+func newRouter(prefix string, srv *Server, ms ...middleware.Middleware) *Router {
 	r := &Router{
-		srv: srv,
+		srv:    srv,
+		prefix: prefix,
+		ms:     ms,
 	}
 	r.pool.New = func() interface{} {
 		return &wrapper{router: r}
@@ -27,16 +35,242 @@ func newRouter(srv *Server) *Router {
 	return r
 }
 
-// Handle registers a new route with a matcher for the Topic.
-func (r *Router) Handle(topic string, h HandlerFunc) {
+// Group returns a new router group with the topic prefix, its middleware run
+// after the server and parent group middleware.
+func (r *Router) Group(prefix string, ms ...middleware.Middleware) *Router {
+	groupMs := make([]middleware.Middleware, 0, len(r.ms)+len(ms))
+	groupMs = append(groupMs, r.ms...)
+	groupMs = append(groupMs, ms...)
+	return newRouter(r.prefix+prefix, r.srv, groupMs...)
+}
+
+// ReplyOptions are the reply options of a route.
+type ReplyOptions struct {
+	Qos    byte
+	Retain bool
+	// Topic overrides the reply topic derived from the request topic.
+	Topic string
+	// TopicFunc derives the reply topic from the request topic, defaults to
+	// the ReplyTopicStrategy of the server.
+	TopicFunc ReplyTopicFunc
+}
+
+// RouteOption is a route option.
+type RouteOption func(*routeOptions)
+
+type routeOptions struct {
+	pattern   string
+	reply     ReplyOptions
+	codec     string
+	ms        []middleware.Middleware
+	priority  int
+	encHeader EncodeHeaderFunc
+	omitID    bool
+	suffix    bool
+}
+
+// ReplyQos with the qos of the route replies.
+func ReplyQos(qos byte) RouteOption {
+	return func(o *routeOptions) {
+		o.reply.Qos = qos
+	}
+}
+
+// ReplyRetain with the retain flag of the route replies.
+func ReplyRetain(retain bool) RouteOption {
+	return func(o *routeOptions) {
+		o.reply.Retain = retain
+	}
+}
+
+// ReplyTopic with the topic the route replies are published to.
+func ReplyTopic(topic string) RouteOption {
+	return func(o *routeOptions) {
+		o.reply.Topic = topic
+	}
+}
+
+// RouteReplyTopicStrategy with the reply topic strategy of the route.
+func RouteReplyTopicStrategy(f ReplyTopicFunc) RouteOption {
+	return func(o *routeOptions) {
+		o.reply.TopicFunc = f
+	}
+}
+
+// RouteCodec with the codec name of the route messages that carry neither
+// an MQTT v5 content type nor a codec topic suffix, defaults to json.
+func RouteCodec(name string) RouteOption {
+	return func(o *routeOptions) {
+		o.codec = name
+	}
+}
+
+// RouteCodecSuffix picks the codec of the route messages from the last topic
+// level, eg /json or /pb, see RegisterCodec. Only for the routes whose last
+// level is a codec name, never a topic param such as a device name.
+func RouteCodecSuffix() RouteOption {
+	return func(o *routeOptions) {
+		o.suffix = true
+	}
+}
+
+// RouteOmitRequestID omits the request id from the JSON replies of the
+// route, by default it is echoed in the replies that have none, see
+// PayloadRequestID.
+func RouteOmitRequestID() RouteOption {
+	return func(o *routeOptions) {
+		o.omitID = true
+	}
+}
 
+// RouteMiddleware with the middleware of the route, run after the server and
+// group middleware.
+func RouteMiddleware(m ...middleware.Middleware) RouteOption {
+	return func(o *routeOptions) {
+		o.ms = append(o.ms, m...)
+	}
+}
+
+// RoutePriority with the priority of the route among the overlapping routes
+// matching a topic, the higher first, see mux.MatchLevels.
+func RoutePriority(priority int) RouteOption {
+	return func(o *routeOptions) {
+		o.priority = priority
+	}
+}
+
+type routeKey struct{}
+
+// ReplyOptionsFromContext returns the reply options of the route handling
+// the message.
+func ReplyOptionsFromContext(ctx context.Context) ReplyOptions {
+	if o, ok := ctx.Value(routeKey{}).(*routeOptions); ok {
+		return o.reply
+	}
+	return ReplyOptions{}
+}
+
+// Handle registers a new route with a matcher for the Topic, prefixed by the
+// group prefix.
+func (r *Router) Handle(topic string, h HandlerFunc, opts ...RouteOption) {
+	topic = r.prefix + topic
+	route := &routeOptions{pattern: topic, reply: ReplyOptions{TopicFunc: r.srv.replyTopic}, encHeader: r.srv.encHeader}
+	for _, o := range opts {
+		o(route)
+	}
+	// the route runs the server, group then route middleware
+	ms := make([]middleware.Middleware, 0, len(r.srv.ms)+len(r.ms)+len(route.ms))
+	ms = append(ms, r.srv.ms...)
+	ms = append(ms, r.ms...)
+	route.ms = append(ms, route.ms...)
 	next := mux.HandlerFunc(func(c mqtt.Client, msg mqtt.Message, ps *mux.Params) {
+		r.srv.inflight.add()
+		defer r.srv.inflight.done()
+		tr := &Transport{
+			endpoint:    r.srv.endpoint,
+			operation:   topic,
+			topic:       msg.Topic(),
+			reqHeader:   headerCarrier{},
+			replyHeader: headerCarrier{},
+		}
+		if m, ok := msg.(PropertiesMessage); ok && m.Properties() != nil {
+			for _, p := range m.Properties().User {
+				tr.reqHeader.Set(p.Key, p.Value)
+			}
+		}
+		if r.srv.decHeader != nil {
+			r.srv.decHeader(msg, tr.reqHeader)
+		}
+		base := context.WithValue(context.Background(), routeKey{}, route)
+		base = context.WithValue(base, waitKey{}, r.srv.handlerWait)
+		base = context.WithValue(base, codecKey{}, messageCodec(msg, route.codec, route.suffix))
+		base = transport.NewServerContext(base, tr)
+		if r.srv.envelope {
+			base = entityRequest(base, msg)
+		}
+		if r.srv.requestID != nil {
+			base = withRequestID(base, r.srv.requestID, msg)
+		}
+		start := time.Now()
+		st := &messageStatus{}
+		base = context.WithValue(base, statusKey{}, st)
+		var span trace.Span
+		if r.srv.tracer != nil {
+			base, span = r.srv.startSpan(base, topic, msg, tr, ps)
+		}
+		r.srv.metrics.Received(topic)
 		ctx := r.pool.Get().(Context)
-		ctx.Reset(context.Background(), c, msg, ps)
+		ctx.Reset(base, c, msg, ps)
+		defer func() {
+			if rcv := recover(); rcv != nil {
+				r.srv.recoverPanic(ctx, rcv)
+			}
+			r.srv.metrics.Handled(topic, st.get(), time.Since(start))
+			if span != nil {
+				span.End()
+			}
+			ctx.Reset(nil, nil, nil, nil)
+			r.pool.Put(ctx)
+		}()
 		h(ctx)
-		ctx.Reset(nil, nil, nil, nil)
-		r.pool.Put(ctx)
 	})
 
-	r.srv.router.Handle(topic, next)
+	r.srv.router.HandlePriority(topic, route.priority, next)
+}
+
+// inflight counts the messages being handled, Stop waits for them.
+type inflight struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{} // closed when n drops to zero
+}
+
+func (f *inflight) add() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.n == 0 {
+		f.idle = make(chan struct{})
+	}
+	f.n++
+}
+
+func (f *inflight) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n--
+	if f.n == 0 {
+		close(f.idle)
+	}
+}
+
+// track counts the publish token until it completes.
+func (f *inflight) track(token mqtt.Token) {
+	f.add()
+	go func() {
+		<-token.Done()
+		f.done()
+	}()
+}
+
+func (f *inflight) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.n
+}
+
+// wait waits until no message is being handled or the ctx is done.
+func (f *inflight) wait(ctx context.Context) error {
+	f.mu.Lock()
+	if f.n == 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	idle := f.idle
+	f.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,310 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bytectl/gopkg/transport/mqtt/mux"
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/transport"
+)
+
+func TestRouterServerContext(t *testing.T) {
+	srv := NewServer(Broker("tcp://127.0.0.1:1883"), HeaderDecoder(EnvelopeHeaderDecoder("header")))
+	var tr transport.Transporter
+	srv.Route().Handle("/sys/:pk/:dn/thing/event/post", func(ctx Context) {
+		tr, _ = transport.FromServerContext(ctx)
+	})
+	srv.router.ServeMQTT(nil, &testMessage{
+		topic:   "/sys/p1/d1/thing/event/post",
+		payload: []byte(`{"header":{"X-Auth-User":"u1"}}`),
+	})
+	if tr == nil {
+		t.Fatal("expected server transporter in context")
+	}
+	if tr.Kind() != KindMQTT {
+		t.Errorf("expected kind %v, got %v", KindMQTT, tr.Kind())
+	}
+	if tr.Endpoint() != "tcp://127.0.0.1:1883" {
+		t.Errorf("expected endpoint tcp://127.0.0.1:1883, got %v", tr.Endpoint())
+	}
+	if tr.Operation() != "/sys/:pk/:dn/thing/event/post" {
+		t.Errorf("expected route pattern operation, got %v", tr.Operation())
+	}
+	if tr.RequestHeader().Get("X-Auth-User") != "u1" {
+		t.Errorf("expected header u1, got %v", tr.RequestHeader().Get("X-Auth-User"))
+	}
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	var ops []string
+	m := func(handler middleware.Handler) middleware.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			if tr, ok := transport.FromServerContext(ctx); ok {
+				ops = append(ops, tr.Operation())
+			}
+			return handler(context.WithValue(ctx, testKey{}, "v"), req)
+		}
+	}
+	srv := NewServer(Middleware(m))
+	var value interface{}
+	srv.Route().Handle("/sys/:pk/:dn/hello", func(ctx Context) {
+		SetOperation(ctx, "/helloworld.Greeter/SayHello")
+		h := ctx.Middleware(func(ctx context.Context, req interface{}) (interface{}, error) {
+			value = ctx.(Context).Value(testKey{})
+			return nil, nil
+		})
+		_, _ = h(ctx, nil)
+	})
+	srv.router.ServeMQTT(nil, &testMessage{topic: "/sys/p1/d1/hello"})
+	if !reflect.DeepEqual(ops, []string{"/helloworld.Greeter/SayHello"}) {
+		t.Errorf("expected operation set before middleware, got %v", ops)
+	}
+	if value != "v" {
+		t.Errorf("expected middleware value in handler context, got %v", value)
+	}
+}
+
+func TestRouterReplyOptions(t *testing.T) {
+	srv := NewServer(OrderMatters(false))
+	c := &testClient{connected: true, fail: map[string]bool{"/deny": true}}
+	var errs []error
+	r := srv.Route()
+	r.Handle("/sys/:pk/:dn/thing/service/property/set", func(ctx Context) {
+		errs = append(errs, ctx.Reply(&testData{Path: "ok"}))
+	}, ReplyQos(1), ReplyRetain(true))
+	r.Handle("/sys/:pk/:dn/thing/service/invoke", func(ctx Context) {
+		errs = append(errs, ctx.ReplyErr(errors.New(500, "", "")))
+	}, ReplyTopic("/deny"))
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/service/property/set"})
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/service/invoke"})
+
+	if len(c.pubs) != 2 {
+		t.Fatalf("expected 2 replies, got %v", c.pubs)
+	}
+	if p := c.pubs[0]; p.topic != "/device/pk/dn/thing/service/property/set_reply" || p.qos != 1 || !p.retained {
+		t.Errorf("unexpected reply %+v", p)
+	}
+	if errs[0] != nil {
+		t.Errorf("expected no error, got %v", errs[0])
+	}
+	if p := c.pubs[1]; p.topic != "/deny" || p.qos != 0 || p.retained {
+		t.Errorf("unexpected reply %+v", p)
+	}
+	if errs[1] == nil {
+		t.Error("expected publish error")
+	}
+}
+
+func TestRouterCodecOptions(t *testing.T) {
+	var replied, failed []string
+	srv := NewServer(
+		RequestDecoder(func(data []byte, v interface{}) error {
+			*(v.(*string)) = string(data)
+			return nil
+		}),
+		ResponseEncoder(func(_ pmqtt.Client, topic string, v interface{}) error {
+			replied = append(replied, topic+" "+*(v.(*string)))
+			return nil
+		}),
+		ErrorEncoder(func(_ pmqtt.Client, topic string, err error) {
+			failed = append(failed, topic+" "+err.Error())
+		}),
+	)
+	srv.Route().Handle("/sys/:pk/:dn/echo", func(ctx Context) {
+		var in string
+		if err := ctx.Bind(&in); err != nil {
+			t.Fatal(err)
+		}
+		if in == "fail" {
+			if err := ctx.ReplyErr(fmt.Errorf("failed")); err != nil {
+				t.Error(err)
+			}
+			return
+		}
+		if err := ctx.Reply(&in); err != nil {
+			t.Error(err)
+		}
+	})
+	c := &testClient{connected: true}
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/echo", payload: []byte("hi")})
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/echo", payload: []byte("fail")})
+	if want := []string{"/sys/pk/dn/echo hi"}; !reflect.DeepEqual(replied, want) {
+		t.Errorf("expected %v replied, got %v", want, replied)
+	}
+	if want := []string{"/sys/pk/dn/echo failed"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("expected %v failed, got %v", want, failed)
+	}
+}
+
+func TestRouterReplyTimeout(t *testing.T) {
+	c := &testClient{connected: true, hang: true}
+	reply := func(srv *Server) error {
+		var err error
+		srv.Route().Handle("/sys/:pk/:dn/thing/service/property/set", func(ctx Context) {
+			err = ctx.Reply(&testData{Path: "ok"})
+		}, ReplyQos(1))
+		done := make(chan struct{})
+		go func() {
+			srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/service/property/set"})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("expected the reply wait bounded")
+		}
+		return err
+	}
+	// the ordered paho callback goroutine does not wait for the ack
+	if err := reply(NewServer(ReplyTimeout(time.Minute))); err != nil {
+		t.Errorf("expected no wait, got %v", err)
+	}
+	if err := reply(NewServer(OrderMatters(false), ReplyTimeout(10*time.Millisecond))); err == nil {
+		t.Error("expected the reply timeout")
+	}
+}
+
+func TestRouterReplyTopicStrategy(t *testing.T) {
+	srv := NewServer(ReplyTopicStrategy(TSLReplyTopic))
+	c := &testClient{connected: true}
+	r := srv.Route()
+	reply := func(ctx Context) { _ = ctx.Reply(&testData{}) }
+	r.Handle("/sys/:pk/:dn/thing/event/post", reply)
+	r.Handle("/sys/:pk/:dn/thing/service/:id", reply, RouteReplyTopicStrategy(AliyunReplyTopic))
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/event/post"})
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/service/reboot"})
+	if len(c.pubs) != 2 {
+		t.Fatalf("expected 2 replies, got %v", c.pubs)
+	}
+	if c.pubs[0].topic != "/sys/pk/dn/thing/event/post/reply" {
+		t.Errorf("unexpected server strategy reply topic %s", c.pubs[0].topic)
+	}
+	if c.pubs[1].topic != "/sys/pk/dn/thing/service/reboot_reply" {
+		t.Errorf("unexpected route strategy reply topic %s", c.pubs[1].topic)
+	}
+}
+
+func TestRouterRecoverPanic(t *testing.T) {
+	var (
+		recovered interface{}
+		letters   []*DeadLetter
+	)
+	srv := NewServer(
+		PanicReply(true),
+		PanicHandler(func(ctx Context, rcv interface{}) {
+			recovered = rcv
+		}),
+		DeadLetterQueue(DeadLetterFunc(func(ctx context.Context, dl *DeadLetter) error {
+			letters = append(letters, dl)
+			return nil
+		})),
+	)
+	c := &testClient{connected: true}
+	srv.Route().Handle("/sys/:pk/:dn/thing/service/:id", func(ctx Context) {
+		panic("oops")
+	})
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/service/reboot"})
+	if recovered != "oops" {
+		t.Errorf("expected panic handler called, got %v", recovered)
+	}
+	if len(letters) != 1 || letters[0].Reason != ReasonPanic {
+		t.Errorf("expected panic dead letter, got %v", letters)
+	}
+	if len(c.pubs) != 1 || c.pubs[0].topic != "/device/pk/dn/thing/service/reboot_reply" {
+		t.Fatalf("expected error reply, got %v", c.pubs)
+	}
+	if n := srv.inflight.len(); n != 0 {
+		t.Errorf("expected no in-flight message, got %d", n)
+	}
+}
+
+func TestRouterGroup(t *testing.T) {
+	var calls []string
+	mark := func(name string) middleware.Middleware {
+		return func(handler middleware.Handler) middleware.Handler {
+			return func(ctx context.Context, req interface{}) (interface{}, error) {
+				calls = append(calls, name)
+				return handler(ctx, req)
+			}
+		}
+	}
+	srv := NewServer(Middleware(mark("server")))
+	handler := func(ctx Context) {
+		h := ctx.Middleware(func(ctx context.Context, req interface{}) (interface{}, error) {
+			calls = append(calls, "handler")
+			return nil, nil
+		})
+		_, _ = h(ctx, nil)
+	}
+	device := srv.Route().Group("/sys/:pk/:dn", mark("auth"))
+	device.Group("/thing", mark("thing")).Handle("/event/post", handler, RouteMiddleware(mark("route")))
+	srv.Route().Group("/ext/session", mark("session")).Handle("/:pk/:dn/combine/login", handler)
+
+	srv.router.ServeMQTT(nil, &testMessage{topic: "/sys/p1/d1/thing/event/post"})
+	want := []string{"server", "auth", "thing", "route", "handler"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected %v, got %v", want, calls)
+	}
+	calls = nil
+	srv.router.ServeMQTT(nil, &testMessage{topic: "/ext/session/p1/d1/combine/login"})
+	want = []string{"server", "session", "handler"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected %v, got %v", want, calls)
+	}
+}
+
+func TestRouterMatchMQTT(t *testing.T) {
+	srv := NewServer(RouterOptions(mux.Mode(mux.MatchMQTT)))
+	var got []string
+	r := srv.Route()
+	r.Handle("sys/+/+/thing/event/#", func(ctx Context) { got = append(got, "events") })
+	r.Handle("sys/:pk/:dn/thing/event/post", func(ctx Context) { got = append(got, "post") })
+	srv.router.ServeMQTT(nil, &testMessage{topic: "sys/p1/d1/thing/event/post"})
+	if !reflect.DeepEqual(got, []string{"post", "events"}) {
+		t.Errorf("expected delivered to every match, got %v", got)
+	}
+}
+
+func TestRouterPriority(t *testing.T) {
+	srv := NewServer(RouterOptions(mux.Mode(mux.MatchLevels)))
+	var got []string
+	r := srv.Route()
+	r.Handle("/sys/:pk/:dn/thing/event/post", func(ctx Context) { got = append(got, "post") })
+	r.Handle("/sys/:pk/*rest", func(ctx Context) { got = append(got, "rest") }, RoutePriority(1))
+	srv.router.ServeMQTT(nil, &testMessage{topic: "/sys/p1/d1/thing/event/post"})
+	if !reflect.DeepEqual(got, []string{"rest"}) {
+		t.Errorf("expected the priority route, got %v", got)
+	}
+}
+
+func TestRouterConstraint(t *testing.T) {
+	srv := NewServer()
+	c := &testClient{connected: true}
+	var got []string
+	r := srv.Route()
+	r.Handle("/sys/{pk:[a-zA-Z0-9]+}/{dn}/thing/event/post", func(ctx Context) {
+		var v struct {
+			Pk string `json:"pk"`
+			Dn string `json:"dn"`
+		}
+		if err := ctx.BindVars(&v); err != nil {
+			t.Error(err)
+		}
+		got = append(got, v.Pk+"/"+v.Dn)
+	})
+	srv.Subscribe(c, "/sys/{pk:[a-zA-Z0-9]+}/{dn}/thing/event/post", 0)
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/p1/d1/thing/event/post"})
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/p-1/d1/thing/event/post"})
+	if !reflect.DeepEqual(got, []string{"p1/d1"}) {
+		t.Errorf("expected only the valid topic handled, got %v", got)
+	}
+	if !reflect.DeepEqual(c.subs, []string{"/sys/+/+/thing/event/post"}) {
+		t.Errorf("unexpected subscriptions %v", c.subs)
+	}
+}
@@ -2,15 +2,24 @@ package mqtt
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
 	"strings"
 	"time"
 
+	"github.com/bytectl/gopkg/transport/internal/metric"
 	"github.com/bytectl/gopkg/transport/mqtt/mux"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	pmqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/go-kratos/kratos/v2/middleware"
 	"github.com/go-kratos/kratos/v2/transport"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type MQTTSubscribe struct {
@@ -104,6 +113,87 @@ func AutoReconnect(autoReconnect bool) ServerOption {
 	}
 }
 
+// ConnectRetry with mqtt client connectRetry, Start does not wait for the
+// first connection and the client keeps retrying in the background.
+func ConnectRetry(connectRetry bool) ServerOption {
+	return func(o *Server) {
+		o.clientOption.SetConnectRetry(connectRetry)
+	}
+}
+
+// ConnectRetryInterval with mqtt client connectRetryInterval.
+func ConnectRetryInterval(interval time.Duration) ServerOption {
+	return func(o *Server) {
+		o.clientOption.SetConnectRetryInterval(interval)
+	}
+}
+
+// MaxReconnectInterval with mqtt client maxReconnectInterval, the bound of
+// the reconnect backoff.
+func MaxReconnectInterval(interval time.Duration) ServerOption {
+	return func(o *Server) {
+		o.clientOption.SetMaxReconnectInterval(interval)
+	}
+}
+
+// KeepAlive with mqtt client keepAlive.
+func KeepAlive(keepAlive time.Duration) ServerOption {
+	return func(o *Server) {
+		o.clientOption.SetKeepAlive(keepAlive)
+	}
+}
+
+// Will with mqtt client will message, published by the broker when the
+// connection is lost.
+func Will(topic string, payload []byte, qos byte, retained bool) ServerOption {
+	return func(o *Server) {
+		o.clientOption.SetBinaryWill(topic, payload, qos, retained)
+	}
+}
+
+// TLSConfig with mqtt client tls config, used by the brokers with the ssl,
+// tls, mqtts, tcps or wss scheme.
+func TLSConfig(c *tls.Config) ServerOption {
+	return func(o *Server) {
+		o.clientOption.SetTLSConfig(c)
+	}
+}
+
+// RootCAs with the certificate authorities verifying the brokers, set on a
+// copy of the TLSConfig whatever the option order.
+func RootCAs(pool *x509.CertPool) ServerOption {
+	return func(o *Server) {
+		o.rootCAs = pool
+	}
+}
+
+// ClientCertificate with the client certificate presented to the brokers,
+// for mutual TLS, added to a copy of the TLSConfig whatever the option order.
+func ClientCertificate(cert tls.Certificate) ServerOption {
+	return func(o *Server) {
+		o.certs = append(o.certs, cert)
+	}
+}
+
+// Websocket with the websocket options and the handshake headers of the
+// brokers with the ws or wss scheme, paho.mqtt.golang only.
+func Websocket(opts *pmqtt.WebsocketOptions, header http.Header) ServerOption {
+	return func(o *Server) {
+		if opts != nil {
+			o.clientOption.SetWebsocketOptions(opts)
+		}
+		o.clientOption.SetHTTPHeaders(header)
+	}
+}
+
+// Dialer with the dialer of the broker connections, its timeout replaces the
+// connect timeout of the dial, paho.mqtt.golang only.
+func Dialer(d *net.Dialer) ServerOption {
+	return func(o *Server) {
+		o.dialer = d
+	}
+}
+
 // DisconnectQuiesce with mqtt client disconnectQuiesce.
 func DisconnectQuiesce(quiesce uint) ServerOption {
 	return func(o *Server) {
@@ -111,6 +201,29 @@ func DisconnectQuiesce(quiesce uint) ServerOption {
 	}
 }
 
+// ProtocolVersion with mqtt protocol version, 3 (MQTT 3.1) and 4 (MQTT 3.1.1)
+// use paho.mqtt.golang, ProtocolVersionV5 uses paho.golang.
+func ProtocolVersion(version uint) ServerOption {
+	return func(o *Server) {
+		o.clientOption.SetProtocolVersion(version)
+		o.protocolVersion = version
+	}
+}
+
+// ShareGroup subscribes the routes as shared subscriptions of the group.
+func ShareGroup(group string) ServerOption {
+	return func(o *Server) {
+		o.shareGroup = group
+	}
+}
+
+// MessageExpiry with mqtt v5 message expiry interval of published messages.
+func MessageExpiry(expiry time.Duration) ServerOption {
+	return func(o *Server) {
+		o.messageExpiry = expiry
+	}
+}
+
 // Logger with server logger.
 func Logger(logger log.Logger) ServerOption {
 	return func(o *Server) {
@@ -125,34 +238,123 @@ func ConnectionLostHandler(connectLostHandler pmqtt.ConnectionLostHandler) Serve
 	}
 }
 
-// OnConnectHandler with mqtt client onConnectHandler.
+// OnConnectHandler with mqtt client onConnectHandler, it is called after
+// the registered subscriptions are replayed.
 func OnConnectHandler(onConnectHandler pmqtt.OnConnectHandler) ServerOption {
 	return func(o *Server) {
-		o.clientOption.SetOnConnectHandler(onConnectHandler)
+		o.onConnectHandler = onConnectHandler
 	}
 }
 
 // RequestDecoder with request decoder.
 func RequestDecoder(dec DecodeRequestFunc) ServerOption {
 	return func(o *Server) {
-		o.dec = dec
+		o.dec = func(_ context.Context, data []byte, v interface{}) error {
+			return dec(data, v)
+		}
 	}
 }
 
 // ResponseEncoder with response encoder.
 func ResponseEncoder(en EncodeResponseFunc) ServerOption {
 	return func(o *Server) {
-		o.enc = en
+		o.enc = func(_ context.Context, c mqtt.Client, topic string, v interface{}) error {
+			return en(c, topic, v)
+		}
 	}
 }
 
 // ErrorEncoder with error encoder.
 func ErrorEncoder(en EncodeErrorFunc) ServerOption {
+	return func(o *Server) {
+		o.ene = func(_ context.Context, c mqtt.Client, topic string, err error) error {
+			en(c, topic, err)
+			return nil
+		}
+	}
+}
+
+// RequestContextDecoder with request decoder reading the handler context.
+func RequestContextDecoder(dec DecodeRequestContextFunc) ServerOption {
+	return func(o *Server) {
+		o.dec = dec
+	}
+}
+
+// ResponseContextEncoder with response encoder reading the handler context.
+func ResponseContextEncoder(en EncodeResponseContextFunc) ServerOption {
+	return func(o *Server) {
+		o.enc = en
+	}
+}
+
+// ErrorContextEncoder with error encoder reading the handler context, the
+// error publishing the reply is returned by Context.ReplyErr.
+func ErrorContextEncoder(en EncodeErrorContextFunc) ServerOption {
 	return func(o *Server) {
 		o.ene = en
 	}
 }
 
+// HeaderDecoder with request header decoder.
+func HeaderDecoder(dec DecodeHeaderFunc) ServerOption {
+	return func(o *Server) {
+		o.decHeader = dec
+	}
+}
+
+// ReplyTopicStrategy with the reply topic strategy of the routes, defaults to
+// DefaultReplyTopic.
+func ReplyTopicStrategy(f ReplyTopicFunc) ServerOption {
+	return func(o *Server) {
+		o.replyTopic = f
+	}
+}
+
+// PanicHandler with the handler of the panics recovered from the routes.
+func PanicHandler(h PanicHandlerFunc) ServerOption {
+	return func(o *Server) {
+		o.panicHandler = h
+	}
+}
+
+// PanicReply replies an internal server error to the messages whose handler
+// panicked.
+func PanicReply(reply bool) ServerOption {
+	return func(o *Server) {
+		o.panicReply = reply
+	}
+}
+
+// MessageDispatcher with the dispatcher running the handlers, keep
+// OrderMatters(true) so the overflow policy applies to the mqtt client. The
+// messages are acknowledged once queued, see Dispatcher, and the dropped
+// ones are sent to the dead letter sink with ReasonOverflow.
+func MessageDispatcher(d *Dispatcher) ServerOption {
+	return func(o *Server) {
+		o.dispatcher = d
+	}
+}
+
+// RouterOptions with the options of the topic router, eg
+// mux.Mode(mux.MatchMQTT).
+func RouterOptions(opts ...mux.RouterOption) ServerOption {
+	return func(o *Server) {
+		o.routerOpts = append(o.routerOpts, opts...)
+	}
+}
+
+// ClientFactory creates the paho client of the options, eg the in-memory
+// client of the mqtttest package.
+type ClientFactory func(o *pmqtt.ClientOptions) pmqtt.Client
+
+// MQTTClientFactory with the factory of the server paho client.
+func MQTTClientFactory(f ClientFactory) ServerOption {
+	return func(o *Server) {
+		o.newClient = f
+	}
+}
+
 // Middleware with service middleware option.
 func Middleware(m ...middleware.Middleware) ServerOption {
 	return func(o *Server) {
@@ -164,80 +366,254 @@ type Server struct {
 	log               *log.Helper
 	clientOption      *pmqtt.ClientOptions
 	mqttClient        pmqtt.Client
+	newClient         ClientFactory
 	disconnectQuiesce uint
 	router            *mux.Router
+	routerOpts        []mux.RouterOption
 	ms                []middleware.Middleware
-	dec               DecodeRequestFunc
-	enc               EncodeResponseFunc
-	ene               EncodeErrorFunc
+	dec               DecodeRequestContextFunc
+	enc               EncodeResponseContextFunc
+	ene               EncodeErrorContextFunc
+	decHeader         DecodeHeaderFunc
+	encHeader         EncodeHeaderFunc
+	encPublish        EncodeRequestFunc
+	replyTopic        ReplyTopicFunc
+	requestID         RequestIDFunc
+	envelope          bool
+	deadLetter        DeadLetterSink
+	deadLetterLog     logLimiter
+	panicHandler      PanicHandlerFunc
+	panicReply        bool
+	publishMs         []middleware.Middleware
+	endpoint          string
+	protocolVersion   uint
+	shareGroup        string
+	messageExpiry     time.Duration
+	onConnectHandler  pmqtt.OnConnectHandler
+	subs              *subscriptions
+	dispatcher        *Dispatcher
+	inflight          inflight
+	pending           inflight // the publish tokens not completed
+	tracer            trace.Tracer
+	propagator        propagation.TextMapPropagator
+	metrics           metric.Metrics
+	state             connState
+	replyTimeout      time.Duration
+	subscribeTimeout  time.Duration
+	handlerWait       *publishWait
+	callbackWait      *publishWait
+	failover          failover
+	dialer            *net.Dialer
+	rootCAs           *x509.CertPool
+	certs             []tls.Certificate
 }
 
 // NewServer creates an MQTT server by options.
 func NewServer(opts ...ServerOption) *Server {
 	srv := &Server{
-		clientOption: pmqtt.NewClientOptions(),
-		log:          log.NewHelper(log.GetLogger()),
-		dec:          DefaultRequestDecoder,
-		enc:          DefaultResponseEncoder,
-		ene:          DefaultErrorEncoder,
-		router:       mux.NewRouter(),
+		clientOption:     pmqtt.NewClientOptions(),
+		log:              log.NewHelper(log.GetLogger()),
+		dec:              DefaultRequestContextDecoder,
+		enc:              DefaultResponseContextEncoder,
+		ene:              DefaultErrorContextEncoder,
+		encPublish:       DefaultPublishEncoder,
+		replyTopic:       DefaultReplyTopic,
+		requestID:        PayloadRequestID("id"),
+		deadLetterLog:    logLimiter{interval: time.Second},
+		router:           mux.NewRouter(),
+		subs:             newSubscriptions(),
+		propagator:       defaultPropagator(),
+		replyTimeout:     10 * time.Second,
+		subscribeTimeout: 10 * time.Second,
 	}
 	for _, o := range opts {
 		o(srv)
 	}
+	srv.tlsConfig()
+	if srv.dialer != nil {
+		srv.clientOption.SetDialer(srv.dialer)
+	} else {
+		dialTimeout(srv.clientOption)
+	}
+	for _, o := range srv.routerOpts {
+		o(srv.router)
+	}
+	srv.clientOption.SetOnConnectHandler(srv.onConnect)
+	lost := srv.clientOption.OnConnectionLost
+	srv.clientOption.SetConnectionLostHandler(func(c pmqtt.Client, err error) {
+		srv.metrics.Disconnect()
+		srv.state.failed(err)
+		srv.failover.failed(err)
+		if lost != nil {
+			lost(c, err)
+		}
+	})
+	if srv.dispatcher != nil {
+		srv.router.Dispatcher = srv.dispatcher
+		srv.dispatcher.onDrop = func(msg pmqtt.Message, reason string) {
+			srv.sendDeadLetter(srv.callbackContext(), msg, ReasonOverflow, errors.New(reason))
+		}
+	}
+	srv.handlerWait = srv.newPublishWait(srv.router.Dispatcher != nil)
+	srv.callbackWait = srv.newPublishWait(false)
 	srv.router.NotFoundHandle = func(c pmqtt.Client, msg pmqtt.Message, ps *mux.Params) {
-		srv.log.Error("not found handler topic: ", msg.Topic())
+		srv.sendDeadLetter(srv.callbackContext(), msg, ReasonNotFound, nil)
+	}
+	srv.router.PanicHandler = func(c pmqtt.Client, msg pmqtt.Message, rcv interface{}) {
+		srv.log.Errorf("[mqtt] panic topic: %s, %v: %s", msg.Topic(), rcv, stack())
+		srv.sendDeadLetter(srv.callbackContext(), msg, ReasonPanic, fmt.Errorf("panic: %v", rcv))
+	}
+	if len(srv.clientOption.Servers) > 0 {
+		srv.endpoint = srv.clientOption.Servers[0].Redacted()
+	}
+	srv.failover.hook(srv.clientOption)
+	switch {
+	case srv.newClient != nil:
+		srv.mqttClient = srv.newClient(srv.clientOption)
+	case srv.protocolVersion == ProtocolVersionV5:
+		srv.mqttClient = newV5Client(srv.clientOption, srv.messageExpiry)
+	default:
+		srv.mqttClient = pmqtt.NewClient(srv.clientOption)
 	}
-	srv.mqttClient = pmqtt.NewClient(srv.clientOption)
 	return srv
 }
 
+// dialTimeout bounds the broker dial with the connect timeout, paho bounds it
+// with the timeout of its dialer, 30s by default.
+func dialTimeout(o *pmqtt.ClientOptions) {
+	o.SetDialer(&net.Dialer{Timeout: o.ConnectTimeout})
+}
+
+// Start connects to the broker, it waits for the connection until the ctx
+// is done, then aborts the connect. With ConnectRetry it returns at once and keeps connecting in the
+// background, see Ready.
 func (o *Server) Start(ctx context.Context) error {
 	o.log.Info("[mqtt] server starting")
 	token := o.mqttClient.Connect()
-	if !token.WaitTimeout(1 * time.Second) {
-		panic("mqtt connect wait timeout, address: " + o.clientOption.Servers[0].String())
+	if o.clientOption.ConnectRetry {
+		go func() {
+			if token.Wait() && token.Error() != nil {
+				o.state.failed(token.Error())
+				o.failover.failed(token.Error())
+				o.log.Errorf("[mqtt] connect error(%v)", token.Error())
+			}
+		}()
+		return nil
 	}
-	if token.Error() != nil {
-		panic("mqtt connect error, " + token.Error().Error())
+	if err := waitToken(ctx, token); err != nil {
+		if ctx.Err() != nil {
+			// abort the connect still in progress
+			o.mqttClient.Disconnect(0)
+		}
+		o.state.failed(err)
+		o.failover.failed(err)
+		return o.failover.connectError(err)
 	}
 	return nil
 }
 
+// Ready reports whether the server is connected to the broker.
+func (o *Server) Ready() bool {
+	return o.mqttClient.IsConnectionOpen()
+}
+
+// tlsConfig sets the root CAs and the client certificates on a copy of the
+// client tls config, leaving the caller's config untouched.
+func (o *Server) tlsConfig() {
+	if o.rootCAs == nil && len(o.certs) == 0 {
+		return
+	}
+	c := &tls.Config{}
+	if o.clientOption.TLSConfig != nil {
+		c = o.clientOption.TLSConfig.Clone()
+	}
+	if o.rootCAs != nil {
+		c.RootCAs = o.rootCAs
+	}
+	c.Certificates = append(c.Certificates[:len(c.Certificates):len(c.Certificates)], o.certs...)
+	o.clientOption.SetTLSConfig(c)
+}
+
+// Stop drains the server: it unsubscribes the routes, waits for the queued
+// and in-flight handlers then for the pending publishes, replies and dead
+// letters until the ctx is done, then disconnects. When the ctx expires
+// first it returns an error reporting the abandoned messages and the pending
+// publishes.
 func (o *Server) Stop(ctx context.Context) error {
 	o.log.Info("[mqtt] server stopping")
-	o.mqttClient.Disconnect(o.disconnectQuiesce)
+	if topics := o.subs.unsubscribe(); len(topics) > 0 && o.mqttClient.IsConnectionOpen() {
+		if err := waitToken(ctx, o.mqttClient.Unsubscribe(topics...)); err != nil {
+			o.log.Errorf("[mqtt] unsubscribe topics: %v error(%v)", topics, err)
+		}
+	}
+	var err error
+	if o.dispatcher != nil {
+		err = o.dispatcher.Close(ctx)
+	}
+	if err == nil {
+		err = o.inflight.wait(ctx)
+	}
+	if err == nil {
+		err = o.pending.wait(ctx)
+	}
+	abandoned := o.inflight.len()
+	if o.dispatcher != nil {
+		abandoned += o.dispatcher.Len()
+	}
+	pending := o.pending.len()
+	o.mqttClient.Disconnect(o.quiesce(ctx))
+	o.metrics.Disconnect()
+	if err != nil {
+		o.log.Errorf("[mqtt] server stopped, %d messages abandoned, %d publishes pending", abandoned, pending)
+		return fmt.Errorf("mqtt stop: %d messages abandoned, %d publishes pending: %w", abandoned, pending, err)
+	}
+	o.log.Info("[mqtt] server stopped")
 	return nil
 }
 
+// quiesce returns the disconnect quiesce in milliseconds, bounded by the
+// ctx deadline.
+func (o *Server) quiesce(ctx context.Context) uint {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return o.disconnectQuiesce
+	}
+	left := time.Until(deadline).Milliseconds()
+	if left <= 0 {
+		return 0
+	}
+	if uint(left) < o.disconnectQuiesce {
+		return uint(left)
+	}
+	return o.disconnectQuiesce
+}
+
 // Route registers an MQTT router.
 func (s *Server) Route() *Router {
-	return newRouter(s)
+	return newRouter("", s)
 }
 
-// Subscribe to topic
+// Subscribe to topic, the subscription is registered and replayed on every
+// reconnect. It waits for the SUBACK when the client is connected.
 func (s *Server) Subscribe(c mqtt.Client, topic string, qos byte) {
 	if c == nil {
 		panic("server: client must not be nil")
 	}
-	// subscribe to topic
 	subscribeTopic := s.makeSubscribeTopic(topic)
-	c.Subscribe(subscribeTopic, qos, s.router.ServeMQTT)
-	log.Debugf("[server] subscribe to topic: %s", subscribeTopic)
+	if !s.subs.add(subscribeTopic, qos) {
+		return
+	}
+	if !c.IsConnectionOpen() {
+		// subscribed on connect
+		return
+	}
+	s.subscribe(c, subscribeTopic, qos)
 }
 
 func (s *Server) makeSubscribeTopic(topic string) string {
-	dirs := strings.Split(topic, "/")
-	for i, dir := range dirs {
-		if dir == "" {
-			continue
-		}
-		if dir[0] == ':' {
-			dirs[i] = "+"
-		}
-		if dir[0] == '*' {
-			dirs[i] = "#"
-		}
+	subscribeTopic := mux.Filter(topic)
+	if s.shareGroup != "" && !strings.HasPrefix(subscribeTopic, "$share/") {
+		subscribeTopic = "$share/" + s.shareGroup + "/" + subscribeTopic
 	}
-	return strings.Join(dirs, "/")
+	return subscribeTopic
 }
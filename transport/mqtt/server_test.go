@@ -2,6 +2,8 @@ package mqtt
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 )
@@ -26,3 +28,108 @@ func TestServer(t *testing.T) {
 		t.Errorf("expected nil got %v", srv.Stop(ctx))
 	}
 }
+
+func TestServerStartError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	srv := NewServer(Broker("tcp://127.0.0.1:1"))
+	if err := srv.Start(ctx); err == nil {
+		t.Fatal("expected connect error")
+	}
+	if srv.Ready() {
+		t.Error("expected server not ready")
+	}
+}
+
+func TestServerConnectRetry(t *testing.T) {
+	srv := NewServer(Broker("tcp://127.0.0.1:1"), ConnectRetry(true), ConnectRetryInterval(10*time.Millisecond))
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if srv.Ready() {
+		t.Error("expected server not ready")
+	}
+	_ = srv.Stop(context.Background())
+}
+
+func TestServerStartTimeout(t *testing.T) {
+	srv := NewServer()
+	c := &testClient{connected: true, hang: true}
+	srv.mqttClient = c
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := srv.Start(ctx); err == nil {
+		t.Fatal("expected the connect timed out")
+	}
+	if c.IsConnectionOpen() {
+		t.Error("expected the pending connect aborted")
+	}
+}
+
+func TestServerStopPendingPublish(t *testing.T) {
+	srv := NewServer()
+	c := &testClient{connected: true, hang: true}
+	srv.mqttClient = c
+	publish := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		if err := srv.Publish(ctx, "/ota/p1/upgrade", []byte("v2"), PublishQos(1)); err == nil {
+			t.Fatal("expected the publish not acked")
+		}
+	}
+	publish()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := srv.Stop(ctx); err == nil || !strings.Contains(err.Error(), "1 publishes pending") {
+		t.Errorf("expected the pending publish reported, got %v", err)
+	}
+	c.pending[0].complete(errors.New("connection lost"))
+
+	// Stop waits for the ack before disconnecting
+	c = &testClient{connected: true, hang: true}
+	srv.mqttClient = c
+	publish()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.pending[0].complete(nil)
+	}()
+	if err := srv.Stop(context.Background()); err != nil {
+		t.Errorf("expected the pending publish flushed, got %v", err)
+	}
+}
+
+func TestServerStopDrain(t *testing.T) {
+	srv := NewServer()
+	c := &testClient{connected: true}
+	srv.mqttClient = c
+	release := make(chan struct{})
+	started := make(chan struct{})
+	srv.Route().Handle("/sys/:pk/:dn/thing/event/post", func(ctx Context) {
+		close(started)
+		<-release
+	})
+	srv.Subscribe(c, "/sys/:pk/:dn/thing/event/post", 1)
+	go srv.router.ServeMQTT(c, &testMessage{topic: "/sys/pk/dn/thing/event/post"})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := srv.Stop(ctx)
+	if err == nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "1 messages abandoned") {
+		t.Errorf("expected 1 abandoned message, got %v", err)
+	}
+	if len(c.unsubs) != 1 || c.unsubs[0] != "/sys/+/+/thing/event/post" {
+		t.Errorf("expected routes unsubscribed, got %v", c.unsubs)
+	}
+	if c.connected {
+		t.Error("expected disconnected")
+	}
+
+	close(release)
+	if err := srv.Stop(context.Background()); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+}
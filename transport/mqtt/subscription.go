@@ -0,0 +1,189 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Subscription is a topic subscription of the server.
+type Subscription struct {
+	// Topic is the subscribe topic filter.
+	Topic string
+	Qos   byte
+	// Subscribed reports whether the broker acknowledged the subscription on
+	// the current connection.
+	Subscribed bool
+	// Err is the error of the last subscribe, eg a SUBACK failure.
+	Err error
+}
+
+// subscriptions is the registry of server subscriptions, replayed on every
+// (re)connect since a clean session loses them.
+type subscriptions struct {
+	mu     sync.Mutex
+	gen    uint64 // connection generation
+	topics []string
+	subs   map[string]*subscription
+}
+
+type subscription struct {
+	Subscription
+	gen uint64 // generation the subscription was sent in
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{subs: make(map[string]*subscription)}
+}
+
+// add registers the subscription and reports whether it has to be sent
+// on the current connection.
+func (r *subscriptions) add(topic string, qos byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sub, ok := r.subs[topic]
+	if !ok {
+		sub = &subscription{Subscription: Subscription{Topic: topic}}
+		r.subs[topic] = sub
+		r.topics = append(r.topics, topic)
+	} else if sub.Qos == qos && sub.gen == r.gen && sub.Err == nil {
+		return false
+	}
+	sub.Qos = qos
+	sub.gen = r.gen
+	return true
+}
+
+// reconnect starts a new connection generation and returns the
+// subscriptions to replay.
+func (r *subscriptions) reconnect() map[string]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gen++
+	filters := make(map[string]byte, len(r.subs))
+	for topic, sub := range r.subs {
+		sub.gen = r.gen
+		sub.Subscribed = false
+		filters[topic] = sub.Qos
+	}
+	return filters
+}
+
+func (r *subscriptions) done(topic string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if sub, ok := r.subs[topic]; ok {
+		sub.Subscribed = err == nil
+		sub.Err = err
+	}
+}
+
+// unsubscribe marks the subscriptions as not subscribed and returns the
+// topics to unsubscribe, they are kept to be replayed on the next connect.
+func (r *subscriptions) unsubscribe() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	topics := make([]string, 0, len(r.topics))
+	for _, topic := range r.topics {
+		sub := r.subs[topic]
+		if sub.Subscribed {
+			topics = append(topics, topic)
+		}
+		sub.Subscribed = false
+	}
+	return topics
+}
+
+// owner returns the first registered filter matching the topic whose last
+// subscribe did not fail, or "" when none matches.
+func (r *subscriptions) owner(topic string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, filter := range r.topics {
+		if r.subs[filter].Err == nil && matchFilter(filter, topic) {
+			return filter
+		}
+	}
+	return ""
+}
+
+func (r *subscriptions) list() []Subscription {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]Subscription, 0, len(r.topics))
+	for _, topic := range r.topics {
+		list = append(list, r.subs[topic].Subscription)
+	}
+	return list
+}
+
+// Subscriptions returns the registered subscriptions and their status.
+func (s *Server) Subscriptions() []Subscription {
+	return s.subs.list()
+}
+
+// serve returns the message handler of the subscription filter. The clients
+// call the handler of every subscribed filter matching a message, so the
+// message is routed once, by the handler of the first registered one.
+func (s *Server) serve(filter string) pmqtt.MessageHandler {
+	return func(c pmqtt.Client, msg pmqtt.Message) {
+		if owner := s.subs.owner(msg.Topic()); owner != "" && owner != filter {
+			return
+		}
+		s.router.ServeMQTT(c, msg)
+	}
+}
+
+// SubscribeTimeout with the time a subscribe waits for the SUBACK, defaults
+// to 10s. A subscription timed out is recorded as failed and sent again by
+// the next Subscribe or on reconnect.
+func SubscribeTimeout(timeout time.Duration) ServerOption {
+	return func(o *Server) {
+		o.subscribeTimeout = timeout
+	}
+}
+
+// subscribe sends the subscription and records the SUBACK result, bounded
+// by the subscribe timeout.
+func (s *Server) subscribe(c pmqtt.Client, topic string, qos byte) {
+	token := c.Subscribe(topic, qos, s.serve(topic))
+	ctx, cancel := context.WithTimeout(context.Background(), s.subscribeTimeout)
+	defer cancel()
+	err := waitToken(ctx, token)
+	if st, ok := token.(*pmqtt.SubscribeToken); ok && err == nil {
+		// 0x80 is the SUBACK failure return code
+		if code, ok := st.Result()[topic]; ok && code == 0x80 {
+			err = fmt.Errorf("mqtt subscribe %s: broker refused with return code 0x%02x", topic, code)
+		}
+	}
+	s.subs.done(topic, err)
+	if err != nil {
+		s.state.failed(err)
+		s.log.Errorf("[mqtt] subscribe to topic: %s error(%v)", topic, err)
+		return
+	}
+	s.log.Debugf("[mqtt] subscribe to topic: %s", topic)
+}
+
+// onConnect replays the registered subscriptions before calling the
+// user OnConnectHandler.
+func (s *Server) onConnect(c pmqtt.Client) {
+	s.metrics.Connect()
+	s.state.connected()
+	s.failover.connected()
+	var wg sync.WaitGroup
+	for topic, qos := range s.subs.reconnect() {
+		wg.Add(1)
+		go func(topic string, qos byte) {
+			defer wg.Done()
+			s.subscribe(c, topic, qos)
+		}(topic, qos)
+	}
+	wg.Wait()
+	if s.onConnectHandler != nil {
+		s.onConnectHandler(c)
+	}
+}
@@ -0,0 +1,95 @@
+package mqtt
+
+import (
+	"context"
+
+	"github.com/bytectl/gopkg/transport/mqtt/mux"
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/bytectl/gopkg/transport/mqtt"
+
+// TracerProvider with the tracer provider of the message spans, the messages
+// are not traced by default.
+func TracerProvider(tp trace.TracerProvider) ServerOption {
+	return func(o *Server) {
+		o.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// Propagator with the propagator of the trace context carried in the
+// message header, the MQTT v5 user properties or for MQTT 3.1.1 the
+// HeaderDecoder field of the messages and the HeaderEncoder field of the
+// published ones, defaults to the W3C trace context and baggage.
+func Propagator(p propagation.TextMapPropagator) ServerOption {
+	return func(o *Server) {
+		o.propagator = p
+	}
+}
+
+// WithTracerProvider with the tracer provider of the request spans.
+func WithTracerProvider(tp trace.TracerProvider) ClientOption {
+	return func(o *clientOptions) {
+		o.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// WithPropagator with the propagator of the trace context carried in the
+// request header, defaults to the W3C trace context and baggage.
+func WithPropagator(p propagation.TextMapPropagator) ClientOption {
+	return func(o *clientOptions) {
+		o.propagator = p
+	}
+}
+
+func defaultPropagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+}
+
+// startSpan starts the consumer span of the message routed to the pattern,
+// continuing the trace context of the request header.
+func (s *Server) startSpan(ctx context.Context, pattern string, msg pmqtt.Message, tr *Transport, ps *mux.Params) (context.Context, trace.Span) {
+	ctx = s.propagator.Extract(ctx, tr.reqHeader)
+	attrs := []attribute.KeyValue{
+		semconv.MessagingSystemKey.String("mqtt"),
+		semconv.MessagingDestinationKey.String(msg.Topic()),
+		semconv.MessagingDestinationKindTopic,
+		semconv.MessagingOperationProcess,
+		semconv.MessagingMessagePayloadSizeBytesKey.Int(len(msg.Payload())),
+		attribute.String("messaging.mqtt.route", pattern),
+		attribute.Int("messaging.mqtt.qos", int(msg.Qos())),
+	}
+	if ps != nil {
+		for _, p := range *ps {
+			attrs = append(attrs, attribute.String("messaging.mqtt.param."+p.Key, p.Value))
+		}
+	}
+	return s.tracer.Start(ctx, pattern, trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attrs...))
+}
+
+// startProducerSpan starts the span of a message published to the topic of
+// the transport and injects its trace context into the request header.
+func startProducerSpan(ctx context.Context, tracer trace.Tracer, p propagation.TextMapPropagator, tr *Transport) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, tr.topic, trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		semconv.MessagingSystemKey.String("mqtt"),
+		semconv.MessagingDestinationKey.String(tr.topic),
+		semconv.MessagingDestinationKindTopic,
+	))
+	p.Inject(ctx, tr.reqHeader)
+	return ctx, span
+}
+
+// spanError records the error on the span of ctx.
+func spanError(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,142 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bytectl/gopkg/transport/internal/testutil"
+	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/transport"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRouterTracing(t *testing.T) {
+	tp := &testutil.Tracer{}
+	srv := NewServer(TracerProvider(tp), HeaderDecoder(EnvelopeHeaderDecoder("header")))
+	var parent trace.SpanContext
+	srv.Route().Handle("/sys/:pk/:dn/thing/event/post", func(ctx Context) {
+		parent = trace.SpanContextFromContext(ctx)
+		ctx.DeadLetter(ReasonValidate, errors.New("bad request"))
+	})
+	srv.router.ServeMQTT(nil, &testMessage{
+		topic:   "/sys/p1/d1/thing/event/post",
+		payload: []byte(`{"header":{"traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}}`),
+	})
+	if len(tp.Spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(tp.Spans))
+	}
+	span := tp.Spans[0]
+	if span.Name != "/sys/:pk/:dn/thing/event/post" || span.Kind != trace.SpanKindConsumer || !span.Ended {
+		t.Errorf("unexpected span %s %v", span.Name, span.Kind)
+	}
+	if got := span.Parent.SpanID().String(); got != "00f067aa0ba902b7" || !span.Parent.IsRemote() {
+		t.Errorf("expected the trace context continued, got %s", got)
+	}
+	if parent.SpanID() != span.SC.SpanID() {
+		t.Error("expected the span in the handler context")
+	}
+	if span.Attrs["messaging.mqtt.param.pk"].AsString() != "p1" || span.Attrs["messaging.mqtt.param.dn"].AsString() != "d1" {
+		t.Errorf("expected the device params, got %v", span.Attrs)
+	}
+	if span.Attrs["messaging.destination"].AsString() != "/sys/p1/d1/thing/event/post" ||
+		span.Attrs["messaging.mqtt.qos"].AsInt64() != 0 || span.Attrs["messaging.message_payload_size_bytes"].AsInt64() == 0 {
+		t.Errorf("unexpected attributes %v", span.Attrs)
+	}
+	if span.Code != codes.Error || span.Desc != "bad request" {
+		t.Errorf("expected error status, got %v %s", span.Code, span.Desc)
+	}
+}
+
+func TestServerPublishTracing(t *testing.T) {
+	tp := &testutil.Tracer{}
+	srv := NewServer(TracerProvider(tp), PublishMiddleware(func(h middleware.Handler) middleware.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			tr, _ := transport.FromClientContext(ctx)
+			if tr.RequestHeader().Get("traceparent") == "" {
+				t.Error("expected the trace context injected")
+			}
+			return h(ctx, req)
+		}
+	}))
+	srv.mqttClient = &testClient{connected: true}
+	if err := srv.Publish(context.Background(), "/ota/p1/upgrade", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if len(tp.Spans) != 1 || tp.Spans[0].Kind != trace.SpanKindProducer || !tp.Spans[0].Ended {
+		t.Errorf("expected a producer span, got %v", tp.Spans)
+	}
+
+	// MQTT 3.1.1 carries the trace context in the envelope header
+	tp = &testutil.Tracer{}
+	srv = NewServer(TracerProvider(tp),
+		HeaderEncoder(EnvelopeHeaderEncoder("header")), HeaderDecoder(EnvelopeHeaderDecoder("header")))
+	c := &testClient{connected: true}
+	srv.mqttClient = c
+	srv.Route().Handle("/ota/:pk/upgrade", func(ctx Context) {})
+	if err := srv.Publish(context.Background(), "/ota/p1/upgrade", map[string]string{"version": "v2"}); err != nil {
+		t.Fatal(err)
+	}
+	srv.router.ServeMQTT(c, &testMessage{topic: c.pubs[0].topic, payload: c.pubs[0].payload})
+	if len(tp.Spans) != 2 || tp.Spans[1].Kind != trace.SpanKindConsumer {
+		t.Fatalf("expected a producer and a consumer span, got %v", tp.Spans)
+	}
+	if tp.Spans[1].Parent.SpanID() != tp.Spans[0].SC.SpanID() {
+		t.Errorf("expected the consumer span linked to the producer span, got %v", tp.Spans[1].Parent)
+	}
+}
+
+func TestRouterMetrics(t *testing.T) {
+	messages, seconds, connected, reconnects := testutil.NewMetric(), testutil.NewMetric(), testutil.NewMetric(), testutil.NewMetric()
+	srv := NewServer(
+		MessageCounter(messages.Counter()),
+		HandleSeconds(seconds.Observer()),
+		ConnectionGauge(connected.Gauge()),
+		ReconnectCounter(reconnects.Counter()),
+	)
+	c := &testClient{connected: true}
+	r := srv.Route()
+	r.Handle("/sys/:pk/:dn/thing/event/post", func(ctx Context) {
+		if err := ctx.Reply(map[string]string{"id": "1"}); err != nil {
+			t.Error(err)
+		}
+	})
+	r.Handle("/sys/:pk/:dn/thing/event/panic", func(ctx Context) {
+		panic("oops")
+	})
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/p1/d1/thing/event/post", payload: []byte(`{"id":"1"}`)})
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/p1/d2/thing/event/post", payload: []byte(`{"id":"2"}`)})
+	srv.router.ServeMQTT(c, &testMessage{topic: "/sys/p1/d1/thing/event/panic"})
+
+	tests := []struct {
+		lvs  []string
+		want float64
+	}{
+		{[]string{"/sys/:pk/:dn/thing/event/post", StatusReceived}, 2},
+		{[]string{"/sys/:pk/:dn/thing/event/post", StatusReplied}, 2},
+		{[]string{"/sys/:pk/:dn/thing/event/panic", StatusReceived}, 1},
+		{[]string{"/sys/:pk/:dn/thing/event/panic", StatusFailed}, 1},
+	}
+	for _, tt := range tests {
+		if got := messages.Get(tt.lvs...); got != tt.want {
+			t.Errorf("%v: expected %v, got %v", tt.lvs, tt.want, got)
+		}
+	}
+	if got := seconds.Get("/sys/:pk/:dn/thing/event/post"); got != 2 {
+		t.Errorf("expected 2 latencies observed, got %v", got)
+	}
+
+	srv.onConnect(c)
+	srv.clientOption.OnConnectionLost(c, errors.New("lost"))
+	if connected.Get() != 0 || reconnects.Get() != 0 {
+		t.Errorf("expected disconnected, got %v %v", connected.Get(), reconnects.Get())
+	}
+	srv.onConnect(c)
+	if connected.Get() != 1 || reconnects.Get() != 1 {
+		t.Errorf("expected reconnected, got %v %v", connected.Get(), reconnects.Get())
+	}
+	if keys := messages.Keys(); len(keys) != 4 {
+		t.Errorf("unexpected labels %v", keys)
+	}
+}
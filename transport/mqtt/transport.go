@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-kratos/kratos/v2/transport"
+)
+
+// KindMQTT is the transport kind of MQTT.
+const KindMQTT transport.Kind = "mqtt"
+
+var _ Transporter = &Transport{}
+
+// Transporter is mqtt Transporter
+type Transporter interface {
+	transport.Transporter
+	Topic() string
+}
+
+// Transport is an MQTT transport.
+type Transport struct {
+	endpoint    string
+	operation   string
+	topic       string
+	reqHeader   headerCarrier
+	replyHeader headerCarrier
+}
+
+// Kind returns the transport kind.
+func (tr *Transport) Kind() transport.Kind {
+	return KindMQTT
+}
+
+// Endpoint returns the transport endpoint.
+func (tr *Transport) Endpoint() string {
+	return tr.endpoint
+}
+
+// Operation returns the transport operation.
+func (tr *Transport) Operation() string {
+	return tr.operation
+}
+
+// Topic returns the mqtt message topic.
+func (tr *Transport) Topic() string {
+	return tr.topic
+}
+
+// RequestHeader returns the request header.
+func (tr *Transport) RequestHeader() transport.Header {
+	return tr.reqHeader
+}
+
+// ReplyHeader returns the reply header.
+func (tr *Transport) ReplyHeader() transport.Header {
+	return tr.replyHeader
+}
+
+// SetOperation sets the transport operation.
+func SetOperation(ctx context.Context, op string) {
+	if tr, ok := transport.FromServerContext(ctx); ok {
+		if tr, ok := tr.(*Transport); ok {
+			tr.operation = op
+		}
+	}
+}
+
+type headerCarrier http.Header
+
+// Get returns the value associated with the passed key.
+func (hc headerCarrier) Get(key string) string {
+	return http.Header(hc).Get(key)
+}
+
+// Set stores the key-value pair.
+func (hc headerCarrier) Set(key string, value string) {
+	http.Header(hc).Set(key, value)
+}
+
+// Keys lists the keys stored in this carrier.
+func (hc headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(hc))
+	for k := range http.Header(hc) {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,422 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytectl/gopkg/transport/mqtt/internal/wire"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/transport"
+)
+
+// ProtocolVersionV5 is the MQTT 5 protocol version, see ProtocolVersion.
+const ProtocolVersionV5 = 5
+
+var (
+	_ pmqtt.Client      = (*v5Client)(nil)
+	_ PropertiesMessage = (*v5Message)(nil)
+)
+
+// PropertiesMessage is an MQTT 5 message, it exposes the publish properties
+// (response topic, correlation data, user properties...) of the message.
+type PropertiesMessage interface {
+	pmqtt.Message
+	Properties() *paho.PublishProperties
+}
+
+// ReasonCodeError is an MQTT 5 reason code returned by the broker.
+type ReasonCodeError struct {
+	Code   byte
+	Reason string
+}
+
+func (e *ReasonCodeError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("mqtt: reason code 0x%02x", e.Code)
+	}
+	return fmt.Sprintf("mqtt: reason code 0x%02x: %s", e.Code, e.Reason)
+}
+
+type v5Message struct {
+	p *paho.Publish
+}
+
+func (m *v5Message) Duplicate() bool                     { return false }
+func (m *v5Message) Qos() byte                           { return m.p.QoS }
+func (m *v5Message) Retained() bool                      { return m.p.Retain }
+func (m *v5Message) Topic() string                       { return m.p.Topic }
+func (m *v5Message) MessageID() uint16                   { return m.p.PacketID }
+func (m *v5Message) Payload() []byte                     { return m.p.Payload }
+func (m *v5Message) Ack()                                {}
+func (m *v5Message) Properties() *paho.PublishProperties { return m.p.Properties }
+
+// v5Token is a pmqtt.Token completed by an MQTT 5 flow.
+type v5Token struct {
+	done chan struct{}
+	err  error
+}
+
+func newV5Token() *v5Token {
+	return &v5Token{done: make(chan struct{})}
+}
+
+func (t *v5Token) complete(err error) {
+	t.err = err
+	close(t.done)
+}
+
+func (t *v5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *v5Token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *v5Token) Done() <-chan struct{} { return t.done }
+
+func (t *v5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// v5Client implements the paho.mqtt.golang client interface on top of
+// paho.golang, so the server, router and encoders work unchanged in MQTT 5.
+type v5Client struct {
+	opts          *pmqtt.ClientOptions
+	reader        pmqtt.ClientOptionsReader
+	messageExpiry time.Duration
+
+	mu        sync.RWMutex
+	cm        *autopaho.ConnectionManager
+	cancel    context.CancelFunc
+	connected bool
+	routes    map[string]pmqtt.MessageHandler
+}
+
+func newV5Client(opts *pmqtt.ClientOptions, messageExpiry time.Duration) *v5Client {
+	return &v5Client{
+		opts: opts,
+		// ClientOptionsReader can only be built by paho.mqtt.golang itself
+		reader:        pmqtt.NewClient(opts).OptionsReader(),
+		messageExpiry: messageExpiry,
+		routes:        make(map[string]pmqtt.MessageHandler),
+	}
+}
+
+func (c *v5Client) IsConnected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connected
+}
+
+func (c *v5Client) IsConnectionOpen() bool {
+	return c.IsConnected()
+}
+
+// Connect starts the connection manager, the token completes on the first
+// connection or, without ConnectRetry, on the first connection error.
+func (c *v5Client) Connect() pmqtt.Token {
+	token := newV5Token()
+	var once sync.Once
+	complete := func(err error) { once.Do(func() { token.complete(err) }) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := autopaho.ClientConfig{
+		BrokerUrls:        c.opts.Servers,
+		TlsCfg:            c.opts.TLSConfig,
+		KeepAlive:         uint16(c.opts.KeepAlive),
+		ConnectRetryDelay: c.opts.ConnectRetryInterval,
+		ConnectTimeout:    c.opts.ConnectTimeout,
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+			// the manager is stored before OnConnect subscribes with it, it
+			// may run before NewConnection returns
+			c.mu.Lock()
+			if ctx.Err() != nil {
+				c.mu.Unlock()
+				return
+			}
+			c.cm = cm
+			c.connected = true
+			c.mu.Unlock()
+			complete(nil)
+			if c.opts.OnConnect != nil {
+				c.opts.OnConnect(c)
+			}
+		},
+		OnConnectError: func(err error) {
+			if c.opts.ConnectRetry {
+				return
+			}
+			complete(err)
+			cancel()
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: c.opts.ClientID,
+			Router:   paho.NewSingleHandlerRouter(c.route),
+			OnClientError: func(err error) {
+				c.connectionLost(err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				err := &ReasonCodeError{Code: d.ReasonCode}
+				if d.Properties != nil {
+					err.Reason = d.Properties.ReasonString
+				}
+				c.connectionLost(err)
+			},
+		},
+	}
+	username, password := c.opts.Username, c.opts.Password
+	if c.opts.CredentialsProvider != nil {
+		username, password = c.opts.CredentialsProvider()
+	}
+	cfg.SetUsernamePassword(username, []byte(password))
+	if c.opts.WillEnabled {
+		cfg.SetWillMessage(c.opts.WillTopic, c.opts.WillPayload, c.opts.WillQos, c.opts.WillRetained)
+	}
+	cm, err := autopaho.NewConnection(ctx, cfg)
+	if err != nil {
+		cancel()
+		complete(err)
+		return token
+	}
+	c.mu.Lock()
+	c.cm = cm
+	c.cancel = cancel
+	c.mu.Unlock()
+	return token
+}
+
+func (c *v5Client) connectionLost(err error) {
+	c.mu.Lock()
+	c.connected = false
+	c.mu.Unlock()
+	if c.opts.OnConnectionLost != nil {
+		c.opts.OnConnectionLost(c, err)
+	}
+}
+
+// Disconnect waits at most quiesce milliseconds for the connection to close.
+func (c *v5Client) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	cm, stop := c.cm, c.cancel
+	c.cm, c.cancel = nil, nil
+	c.connected = false
+	c.mu.Unlock()
+	if cm == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer cancel()
+	_ = cm.Disconnect(ctx)
+	stop()
+}
+
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload interface{}) pmqtt.Token {
+	return c.PublishProperties(topic, qos, retained, payload, nil)
+}
+
+// PublishProperties publishes a message with MQTT 5 publish properties.
+func (c *v5Client) PublishProperties(topic string, qos byte, retained bool, payload interface{}, props *paho.PublishProperties) pmqtt.Token {
+	token := newV5Token()
+	body, err := wire.PayloadBytes(payload)
+	if err != nil {
+		token.complete(err)
+		return token
+	}
+	if props == nil {
+		props = &paho.PublishProperties{}
+	}
+	if c.messageExpiry > 0 && props.MessageExpiry == nil {
+		props.MessageExpiry = paho.Uint32(uint32(c.messageExpiry / time.Second))
+	}
+	cm := c.manager()
+	if cm == nil {
+		token.complete(autopaho.ConnectionDownError)
+		return token
+	}
+	go func() {
+		ctx, cancel := c.writeContext()
+		defer cancel()
+		resp, err := cm.Publish(ctx, &paho.Publish{
+			QoS:        qos,
+			Retain:     retained,
+			Topic:      topic,
+			Properties: props,
+			Payload:    body,
+		})
+		if err == nil && resp != nil && resp.ReasonCode >= 0x80 {
+			rerr := &ReasonCodeError{Code: resp.ReasonCode}
+			if resp.Properties != nil {
+				rerr.Reason = resp.Properties.ReasonString
+			}
+			err = rerr
+		}
+		token.complete(err)
+	}()
+	return token
+}
+
+// responseClient publishes the reply of an MQTT 5 request to its response
+// topic with the correlation data and the reply header as user properties,
+// whatever the reply topic computed by the response encoder.
+type responseClient struct {
+	*v5Client
+	responseTopic   string
+	correlationData []byte
+	header          transport.Header
+}
+
+func (c *responseClient) Publish(topic string, qos byte, retained bool, payload interface{}) pmqtt.Token {
+	props := &paho.PublishProperties{CorrelationData: c.correlationData}
+	if c.header != nil {
+		for _, k := range c.header.Keys() {
+			props.User.Add(k, c.header.Get(k))
+		}
+	}
+	if c.responseTopic != "" {
+		topic = c.responseTopic
+	}
+	return c.v5Client.PublishProperties(topic, qos, retained, payload, props)
+}
+
+func (c *v5Client) Subscribe(topic string, qos byte, callback pmqtt.MessageHandler) pmqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *v5Client) SubscribeMultiple(filters map[string]byte, callback pmqtt.MessageHandler) pmqtt.Token {
+	token := newV5Token()
+	cm := c.manager()
+	if cm == nil {
+		token.complete(autopaho.ConnectionDownError)
+		return token
+	}
+	sub := &paho.Subscribe{Subscriptions: make(map[string]paho.SubscribeOptions, len(filters))}
+	filterList := make([]string, 0, len(filters))
+	c.mu.Lock()
+	for filter, qos := range filters {
+		sub.Subscriptions[filter] = paho.SubscribeOptions{QoS: qos}
+		filterList = append(filterList, filter)
+		c.routes[filter] = callback
+	}
+	c.mu.Unlock()
+	go func() {
+		ctx, cancel := c.writeContext()
+		defer cancel()
+		sa, err := cm.Subscribe(ctx, sub)
+		if sa != nil {
+			for _, code := range sa.Reasons {
+				if code >= 0x80 {
+					err = &ReasonCodeError{Code: code, Reason: "subscribe " + strings.Join(filterList, ",")}
+					break
+				}
+			}
+		}
+		token.complete(err)
+	}()
+	return token
+}
+
+func (c *v5Client) Unsubscribe(topics ...string) pmqtt.Token {
+	token := newV5Token()
+	c.mu.Lock()
+	for _, topic := range topics {
+		delete(c.routes, topic)
+	}
+	c.mu.Unlock()
+	cm := c.manager()
+	if cm == nil {
+		token.complete(autopaho.ConnectionDownError)
+		return token
+	}
+	go func() {
+		ctx, cancel := c.writeContext()
+		defer cancel()
+		_, err := cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+		token.complete(err)
+	}()
+	return token
+}
+
+func (c *v5Client) AddRoute(topic string, callback pmqtt.MessageHandler) {
+	c.mu.Lock()
+	c.routes[topic] = callback
+	c.mu.Unlock()
+}
+
+func (c *v5Client) OptionsReader() pmqtt.ClientOptionsReader {
+	return c.reader
+}
+
+func (c *v5Client) manager() *autopaho.ConnectionManager {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cm
+}
+
+func (c *v5Client) writeContext() (context.Context, context.CancelFunc) {
+	if c.opts.WriteTimeout > 0 {
+		return context.WithTimeout(context.Background(), c.opts.WriteTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// route delivers an incoming publish to the handlers of every matching filter.
+func (c *v5Client) route(p *paho.Publish) {
+	msg := &v5Message{p: p}
+	c.mu.RLock()
+	var handlers []pmqtt.MessageHandler
+	for filter, h := range c.routes {
+		if h != nil && matchFilter(filter, p.Topic) {
+			handlers = append(handlers, h)
+		}
+	}
+	c.mu.RUnlock()
+	if len(handlers) == 0 && c.opts.DefaultPublishHandler != nil {
+		handlers = append(handlers, c.opts.DefaultPublishHandler)
+	}
+	for _, h := range handlers {
+		h(c, msg)
+	}
+}
+
+// matchFilter reports whether the topic matches the subscription filter.
+func matchFilter(filter, topic string) bool {
+	if strings.HasPrefix(filter, "$share/") {
+		if parts := strings.SplitN(filter, "/", 3); len(parts) == 3 {
+			filter = parts[2]
+		}
+	}
+	filter = strings.TrimPrefix(filter, "$queue/")
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
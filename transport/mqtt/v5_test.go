@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/transport"
+)
+
+func TestMatchFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"/sys/+/+/thing/event/post", "/sys/p1/d1/thing/event/post", true},
+		{"/sys/+/+/thing/event/post", "/sys/p1/d1/thing/event", false},
+		{"/sys/#", "/sys/p1/d1/thing/event/post", true},
+		{"$share/g1//sys/+/+/thing/#", "/sys/p1/d1/thing/event/post", true},
+		{"$queue//sys/+/d1/thing", "/sys/p1/d1/thing", true},
+		{"/sys/+", "/sys/p1/d1", false},
+	}
+	for _, test := range tests {
+		if got := matchFilter(test.filter, test.topic); got != test.want {
+			t.Errorf("matchFilter(%q, %q) = %v, want %v", test.filter, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestV5Token(t *testing.T) {
+	token := newV5Token()
+	if token.WaitTimeout(time.Millisecond) {
+		t.Fatal("expected token not completed")
+	}
+	token.complete(&ReasonCodeError{Code: 0x87, Reason: "not authorized"})
+	if !token.WaitTimeout(time.Millisecond) {
+		t.Fatal("expected token completed")
+	}
+	if token.Error() == nil || token.Error().Error() != "mqtt: reason code 0x87: not authorized" {
+		t.Errorf("unexpected token error %v", token.Error())
+	}
+}
+
+func TestV5OptionsReader(t *testing.T) {
+	opts := pmqtt.NewClientOptions().SetClientID("c1").AddBroker("tcp://127.0.0.1:1883")
+	c := newV5Client(opts, 0)
+	r := c.OptionsReader()
+	if r.ClientID() != "c1" || len(r.Servers()) != 1 {
+		t.Errorf("unexpected options %s %v", r.ClientID(), r.Servers())
+	}
+	if allocs := testing.AllocsPerRun(10, func() { c.OptionsReader() }); allocs != 0 {
+		t.Errorf("expected the reader built once, got %v allocs per call", allocs)
+	}
+}
+
+func TestV5UserPropertiesHeader(t *testing.T) {
+	srv := NewServer(Broker("tcp://127.0.0.1:1883"), ProtocolVersion(ProtocolVersionV5))
+	if _, ok := srv.mqttClient.(*v5Client); !ok {
+		t.Fatalf("expected mqtt v5 client, got %T", srv.mqttClient)
+	}
+	var (
+		header transport.Header
+		reply  interface{}
+	)
+	srv.Route().Handle("/sys/:pk/:dn/hello", func(ctx Context) {
+		tr, _ := transport.FromServerContext(ctx)
+		header = tr.RequestHeader()
+		reply = ctx.(*wrapper).replyClient()
+	})
+	msg := &v5Message{p: &paho.Publish{
+		Topic: "/sys/p1/d1/hello",
+		Properties: &paho.PublishProperties{
+			ResponseTopic:   "/reply/c1",
+			CorrelationData: []byte("1"),
+			User:            paho.UserProperties{{Key: "X-Auth-User", Value: "u1"}},
+		},
+	}}
+	srv.router.ServeMQTT(srv.mqttClient, msg)
+	if header == nil || header.Get("X-Auth-User") != "u1" {
+		t.Errorf("expected header from user properties, got %v", header)
+	}
+	rc, ok := reply.(*responseClient)
+	if !ok {
+		t.Fatalf("expected response client, got %T", reply)
+	}
+	if rc.responseTopic != "/reply/c1" || string(rc.correlationData) != "1" {
+		t.Errorf("unexpected response client %+v", rc)
+	}
+}
+
+func TestShareGroup(t *testing.T) {
+	srv := NewServer(ShareGroup("g1"))
+	if got := srv.makeSubscribeTopic("/sys/:pk/:dn/*any"); got != "$share/g1//sys/+/+/#" {
+		t.Errorf("unexpected subscribe topic %s", got)
+	}
+}
+
+// serveV5Broker accepts a connection and acknowledges the connect and the
+// (un)subscriptions, as an MQTT v5 broker.
+func serveV5Broker(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			cp, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			var reply *packets.ControlPacket
+			switch p := cp.Content.(type) {
+			case *packets.Connect:
+				reply = packets.NewControlPacket(packets.CONNACK)
+			case *packets.Subscribe:
+				reply = packets.NewControlPacket(packets.SUBACK)
+				suback := reply.Content.(*packets.Suback)
+				suback.PacketID = p.PacketID
+				for _, o := range p.Subscriptions {
+					suback.Reasons = append(suback.Reasons, o.QoS)
+				}
+			case *packets.Unsubscribe:
+				reply = packets.NewControlPacket(packets.UNSUBACK)
+				unsuback := reply.Content.(*packets.Unsuback)
+				unsuback.PacketID = p.PacketID
+				unsuback.Reasons = make([]byte, len(p.Topics))
+			case *packets.Pingreq:
+				reply = packets.NewControlPacket(packets.PINGRESP)
+			case *packets.Disconnect:
+				return
+			default:
+				continue
+			}
+			if _, err := reply.WriteTo(conn); err != nil {
+				return
+			}
+		}
+	}()
+	return "tcp://" + l.Addr().String()
+}
+
+func TestV5SubscribeOnConnect(t *testing.T) {
+	srv := NewServer(Broker(serveV5Broker(t)), ProtocolVersion(ProtocolVersionV5), ConnectTimeout(time.Second))
+	srv.Subscribe(srv.mqttClient, "/sys/:pk/:dn/thing/event/post", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop(ctx)
+	for {
+		if subs := srv.Subscriptions(); len(subs) == 1 && subs[0].Subscribed {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected the subscription replayed on connect, got %+v", srv.Subscriptions())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}